@@ -0,0 +1,15 @@
+package atomicfile
+
+import "os"
+
+// WriteFile writes data to a file like os.WriteFile. The data is written to a
+// temporary file first, which then replaces the file, so that an interruption
+// never leaves a truncated file behind.
+func WriteFile(name string, data []byte, perm os.FileMode) error {
+	tmpFile := name + ".tmp"
+	if err := os.WriteFile(tmpFile, data, perm); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpFile, name)
+}
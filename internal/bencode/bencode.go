@@ -11,8 +11,14 @@ import (
 	"unicode"
 )
 
+// Raw is an already bencoded value, which Encode copies as is.
+type Raw []byte
+
 func Encode(data interface{}) ([]byte, error) {
 	switch value := data.(type) {
+	case Raw:
+		return slices.Clone(value), nil
+
 	case string:
 		return []byte(fmt.Sprintf("%d:%s", len(value), value)), nil
 
@@ -60,8 +66,24 @@ func Encode(data interface{}) ([]byte, error) {
 	}
 }
 
+// decoder reads bencoded values from a byte slice.
+type decoder struct {
+	*bufio.Reader
+	src *bytes.Reader
+}
+
+func newDecoder(data []byte) decoder {
+	src := bytes.NewReader(data)
+	return decoder{Reader: bufio.NewReader(src), src: src}
+}
+
+// remaining returns the number of bytes left to read.
+func (d decoder) remaining() int {
+	return d.src.Len() + d.Buffered()
+}
+
 func Decode(value []byte) (interface{}, error) {
-	reader := bufio.NewReader(bytes.NewReader(value))
+	reader := newDecoder(value)
 
 	obj, err := decode(reader)
 	if err != nil {
@@ -71,7 +93,20 @@ func Decode(value []byte) (interface{}, error) {
 	return obj, nil
 }
 
-func decode(reader *bufio.Reader) (interface{}, error) {
+// DecodePrefix decodes the value at the start of data, which may be followed by
+// something else, and returns it along with the length of its encoding.
+func DecodePrefix(data []byte) (interface{}, int, error) {
+	reader := newDecoder(data)
+
+	obj, err := decode(reader)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return obj, len(data) - reader.remaining(), nil
+}
+
+func decode(reader decoder) (interface{}, error) {
 	b, err := reader.ReadByte()
 	if err != nil {
 		return nil, err
@@ -94,7 +129,7 @@ func decode(reader *bufio.Reader) (interface{}, error) {
 	}
 }
 
-func decodeDictionary(reader *bufio.Reader) (map[string]interface{}, error) {
+func decodeDictionary(reader decoder) (map[string]interface{}, error) {
 	dict := map[string]interface{}{}
 	var lastKey string
 
@@ -133,7 +168,7 @@ func decodeDictionary(reader *bufio.Reader) (map[string]interface{}, error) {
 	return dict, nil
 }
 
-func decodeList(reader *bufio.Reader) ([]interface{}, error) {
+func decodeList(reader decoder) ([]interface{}, error) {
 	list := []interface{}{}
 	for {
 		b, err := reader.ReadByte()
@@ -159,7 +194,7 @@ func decodeList(reader *bufio.Reader) ([]interface{}, error) {
 	return list, nil
 }
 
-func decodeInteger(reader *bufio.Reader) (int, error) {
+func decodeInteger(reader decoder) (int, error) {
 	intbuf, err := reader.ReadBytes('e')
 	if err != nil {
 		return 0, fmt.Errorf("could not read integer bytes: %w", err)
@@ -174,7 +209,7 @@ func decodeInteger(reader *bufio.Reader) (int, error) {
 	return num, nil
 }
 
-func decodeString(reader *bufio.Reader) (string, error) {
+func decodeString(reader decoder) (string, error) {
 	lbuf, err := reader.ReadBytes(':')
 	if err != nil {
 		return "", fmt.Errorf("could not find string separator: %w", err)
@@ -186,6 +221,11 @@ func decodeString(reader *bufio.Reader) (string, error) {
 		return "", fmt.Errorf("could not read string length: %w", err)
 	}
 
+	// The length is checked before allocating, as it comes from the input.
+	if length < 0 || length > reader.remaining() {
+		return "", fmt.Errorf("invalid string length: %d", length)
+	}
+
 	strbuf := make([]byte, length)
 	if _, err := io.ReadFull(reader, strbuf); err != nil {
 		return "", fmt.Errorf("could not read string payload: %w", err)
@@ -0,0 +1,49 @@
+package bitfield
+
+import "math/bits"
+
+// Bitfield is a set of piece indexes encoded as in the peer wire protocol: the
+// high bit of the first byte is piece 0.
+type Bitfield []byte
+
+func New(length int) Bitfield {
+	return make(Bitfield, (length+7)/8)
+}
+
+func (b Bitfield) Has(index int) bool {
+	if index < 0 || index/8 >= len(b) {
+		return false
+	}
+	return b[index/8]&(0x80>>(index%8)) != 0
+}
+
+func (b Bitfield) Set(index int) {
+	if index < 0 || index/8 >= len(b) {
+		return
+	}
+	b[index/8] |= 0x80 >> (index % 8)
+}
+
+func (b Bitfield) Clear(index int) {
+	if index < 0 || index/8 >= len(b) {
+		return
+	}
+	b[index/8] &^= 0x80 >> (index % 8)
+}
+
+func (b Bitfield) Count() int {
+	count := 0
+	for _, v := range b {
+		count += bits.OnesCount8(v)
+	}
+	return count
+}
+
+// Full returns a bitfield with every one of length pieces set.
+func Full(length int) Bitfield {
+	b := New(length)
+	for i := range length {
+		b.Set(i)
+	}
+	return b
+}
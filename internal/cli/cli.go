@@ -1,15 +1,45 @@
 package cli
 
 import (
+	"context"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
 	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/codecrafters-io/bittorrent-starter-go/internal/bencode"
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/dht"
 	"github.com/codecrafters-io/bittorrent-starter-go/internal/peer"
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/storage"
 	"github.com/codecrafters-io/bittorrent-starter-go/internal/torrent"
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/tracker"
+)
+
+const (
+	// scrapeTimeout bounds how long the scrape command waits for each tracker.
+	scrapeTimeout = 30 * time.Second
+	// dhtTimeout bounds how long joining the DHT and looking up or announcing
+	// a torrent take.
+	dhtTimeout = time.Minute
+	// dhtAnnounceInterval is how often a seeded torrent is announced to the
+	// DHT, as nodes forget about peers after 30 minutes.
+	dhtAnnounceInterval = 15 * time.Minute
+
+	// dhtBootstrapEnv overrides the comma-separated list of nodes to join the
+	// DHT through, for example to use a private network of local nodes.
+	dhtBootstrapEnv = "MYBITTORRENT_DHT_BOOTSTRAP"
+	// dhtStateEnv overrides the file the DHT node ID and routing table are
+	// kept in across runs. Setting it empty disables the state file.
+	dhtStateEnv = "MYBITTORRENT_DHT_STATE"
 )
 
 var commands = map[string]func([]string) error{
@@ -44,6 +74,14 @@ var commands = map[string]func([]string) error{
 			fmt.Println(hex.EncodeToString(hash[:]))
 		}
 
+		if t.IsMultiFile() {
+			fmt.Printf("Name: %s\n", t.Name)
+			fmt.Println("Files:")
+			for _, f := range t.Files {
+				fmt.Printf("%s (%d)\n", filepath.Join(f.Path...), f.Length)
+			}
+		}
+
 		return nil
 	},
 
@@ -53,7 +91,8 @@ var commands = map[string]func([]string) error{
 			return err
 		}
 
-		peerAddresses, err := peer.FetchAddresses(t.TrackerURL, t.Hash, t.Length)
+		peerAddresses, err := fetchAddresses(t.Trackers, t.Hash, t.Length)
+		peerAddresses, err = findPeers(t.Hash, t.Private, peerAddresses, err)
 		if err != nil {
 			return err
 		}
@@ -104,7 +143,8 @@ var commands = map[string]func([]string) error{
 			return err
 		}
 
-		peerAddresses, err := peer.FetchAddresses(t.TrackerURL, t.Hash, t.Length)
+		peerAddresses, err := fetchAddresses(t.Trackers, t.Hash, t.Length)
+		peerAddresses, err = findPeers(t.Hash, t.Private, peerAddresses, err)
 		if err != nil {
 			return err
 		}
@@ -115,11 +155,11 @@ var commands = map[string]func([]string) error{
 		}
 		defer clients.Close()
 
-		if err := clients.Handshake(t.Hash); err != nil {
+		if clients, err = t.Handshake(clients, 0); err != nil {
 			return err
 		}
 
-		if err := clients.Unchoke(); err != nil {
+		if clients, err = clients.Unchoke(); err != nil {
 			return err
 		}
 
@@ -142,15 +182,66 @@ var commands = map[string]func([]string) error{
 	},
 
 	"download": func(args []string) error {
-		outputFile := args[3]
-		inputFile := args[4]
+		fs := flag.NewFlagSet("download", flag.ContinueOnError)
+		outputFile := fs.String("o", "", "path to save the torrent to")
+		seed := fs.Bool("seed", false, "upload to other peers during the download and keep seeding once it completes")
+		port := fs.Int("port", peer.DefaultPort, "port to accept peer connections on when seeding")
+		sequential := fs.Bool("sequential", false, "download pieces in order instead of rarest first")
 
-		t, err := torrent.FromFile(inputFile)
+		positional, err := parseFlags(fs, args[2:])
+		if err != nil {
+			return err
+		}
+		if len(positional) != 1 || *outputFile == "" {
+			return errors.New("usage: download -o <output> [--seed] [--port <port>] [--sequential] <torrent>")
+		}
+
+		t, err := torrent.FromFile(positional[0])
+		if err != nil {
+			return err
+		}
+
+		var l *peer.Listener
+		var listenPort int
+		if *seed {
+			if l, err = peer.Listen(fmt.Sprintf(":%d", *port)); err != nil {
+				return err
+			}
+			defer l.Close()
+			listenPort = l.Port()
+		}
+
+		store, err := storage.NewSparseFile(t.StorageFiles(*outputFile))
+		if err != nil {
+			return err
+		}
+		defer store.Close()
+
+		// The pieces left from an interrupted download are loaded first, so
+		// that trackers are told how much is really left.
+		resumeFile := torrent.ResumeFilePath(*outputFile)
+		completed, err := t.LoadCompletedPieces(store, resumeFile)
 		if err != nil {
 			return err
 		}
 
-		peerAddresses, err := peer.FetchAddresses(t.TrackerURL, t.Hash, t.Length)
+		stats := torrent.NewStats(t.MissingLength(completed))
+
+		// Pieces are uploaded as soon as they are downloaded, so that the port
+		// announced is served from the start.
+		var seeder *torrent.Seeder
+		var served <-chan error
+		if *seed {
+			seeder = torrent.NewSeeder(t, store, completed, stats)
+			served = serveSeeder(seeder, l)
+		}
+
+		trackers := tracker.NewSession(t.Trackers, t.Hash, listenPort, stats)
+		defer trackers.Stop()
+		printTrackerWarnings(trackers)
+
+		peerAddresses, err := trackers.Start()
+		peerAddresses, err = findPeers(t.Hash, t.Private, peerAddresses, err)
 		if err != nil {
 			return err
 		}
@@ -161,28 +252,228 @@ var commands = map[string]func([]string) error{
 		}
 		defer clients.Close()
 
-		if err := clients.Handshake(t.Hash); err != nil {
+		if clients, err = t.Handshake(clients, listenPort); err != nil {
 			return err
 		}
 
-		if err := clients.Unchoke(); err != nil {
+		if clients, err = clients.Unchoke(); err != nil {
 			return err
 		}
 
-		data, err := t.Download(clients)
+		opts := torrent.DownloadOptions{
+			ResumeFile: resumeFile,
+			Completed:  completed,
+			Stats:      stats,
+			Seeder:     seeder,
+			Peers:      trackers.Peers(),
+			Port:       listenPort,
+		}
+		if *sequential {
+			opts.Picker = torrent.NewSequentialPicker()
+		}
+
+		if err := t.Download(clients, store, opts); err != nil {
+			return err
+		}
+		trackers.Completed()
+
+		if !*seed {
+			return nil
+		}
+
+		clients.Close()
+		return seedTorrent(t, seeder, l, served)
+	},
+
+	"seed": func(args []string) error {
+		fs := flag.NewFlagSet("seed", flag.ContinueOnError)
+		port := fs.Int("port", peer.DefaultPort, "port to accept peer connections on")
+
+		positional, err := parseFlags(fs, args[2:])
 		if err != nil {
 			return err
 		}
+		if len(positional) != 2 {
+			return errors.New("usage: seed [--port <port>] <torrent> <path>")
+		}
 
-		f, err := os.Create(outputFile)
-		if err != err {
+		t, err := torrent.FromFile(positional[0])
+		if err != nil {
 			return err
 		}
-		defer f.Close()
 
-		if _, err := f.Write(data); err != nil {
+		// The data is only read, and a wrong path is an error rather than a
+		// torrent with nothing to seed.
+		files := t.StorageFiles(positional[1])
+		for _, f := range files {
+			if _, err := os.Stat(f.Path); err != nil {
+				return fmt.Errorf("could not open data to seed: %w", err)
+			}
+		}
+
+		store := storage.OpenFile(files)
+		defer store.Close()
+
+		completed, err := t.VerifyPieces(store)
+		if err != nil {
+			return err
+		}
+
+		l, err := peer.Listen(fmt.Sprintf(":%d", *port))
+		if err != nil {
 			return err
 		}
+		defer l.Close()
+
+		stats := torrent.NewStats(t.MissingLength(completed))
+		trackers := tracker.NewSession(t.Trackers, t.Hash, l.Port(), stats)
+		defer trackers.Stop()
+		printTrackerWarnings(trackers)
+
+		if _, err := trackers.Start(); err != nil {
+			fmt.Fprintln(os.Stderr, "could not announce to trackers:", err)
+		}
+
+		seeder := torrent.NewSeeder(t, store, completed, stats)
+		return seedTorrent(t, seeder, l, serveSeeder(seeder, l))
+	},
+
+	"verify": func(args []string) error {
+		inputFile := args[2]
+		dataPath := args[3]
+
+		t, err := torrent.FromFile(inputFile)
+		if err != nil {
+			return err
+		}
+
+		// Missing files fail verification instead of being created.
+		store := storage.OpenFile(t.StorageFiles(dataPath))
+		defer store.Close()
+
+		verified := 0
+		for i := range t.PieceHashes {
+			ok, err := t.VerifyPiece(store, i)
+			if err != nil {
+				return err
+			}
+
+			status := "fail"
+			if ok {
+				status = "ok"
+				verified++
+			}
+			fmt.Printf("Piece %d: %s\n", i, status)
+		}
+
+		completion := 100.0
+		if len(t.PieceHashes) > 0 {
+			completion = float64(verified) * 100 / float64(len(t.PieceHashes))
+		}
+		fmt.Printf("Completion: %.2f%% (%d/%d pieces)\n", completion, verified, len(t.PieceHashes))
+
+		if verified != len(t.PieceHashes) {
+			return fmt.Errorf("%d pieces failed verification", len(t.PieceHashes)-verified)
+		}
+
+		return nil
+	},
+
+	"create": func(args []string) error {
+		fs := flag.NewFlagSet("create", flag.ContinueOnError)
+		outputFile := fs.String("o", "", "path of the .torrent file to write")
+		announce := fs.String("announce", "", "tracker announce URL")
+		var announceList tiersFlag
+		fs.Var(&announceList, "announce-list", "comma-separated tracker URLs of one tier, can be repeated")
+		comment := fs.String("comment", "", "free-form comment")
+		createdBy := fs.String("created-by", "mybittorrent", "name of the program creating the torrent")
+		private := fs.Bool("private", false, "mark the torrent as private")
+		pieceLength := fs.Int("piece-length", 0, "piece length in bytes, picked automatically when zero")
+
+		positional, err := parseFlags(fs, args[2:])
+		if err != nil {
+			return err
+		}
+		if len(positional) != 1 {
+			return errors.New("usage: create [options] <file or directory>")
+		}
+
+		if *announce == "" && len(announceList) > 0 {
+			*announce = announceList[0][0]
+		}
+
+		data, err := torrent.Create(positional[0], torrent.CreateOptions{
+			Announce:     *announce,
+			AnnounceList: announceList,
+			Comment:      *comment,
+			CreatedBy:    *createdBy,
+			CreationDate: time.Now(),
+			Private:      *private,
+			PieceLength:  *pieceLength,
+		})
+		if err != nil {
+			return err
+		}
+
+		if *outputFile == "" {
+			*outputFile = filepath.Base(filepath.Clean(positional[0])) + ".torrent"
+		}
+
+		if err := os.WriteFile(*outputFile, data, 0o644); err != nil {
+			return err
+		}
+
+		t, err := torrent.FromFile(*outputFile)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Info Hash: %s\n", hex.EncodeToString(t.Hash[:]))
+
+		return nil
+	},
+
+	"scrape": func(args []string) error {
+		if len(args) != 3 {
+			return errors.New("usage: scrape <torrent|magnet link>")
+		}
+
+		var hash [20]byte
+		var tiers [][]string
+		if strings.HasPrefix(args[2], "magnet:") {
+			ml, err := torrent.ParseMagnetLink(args[2])
+			if err != nil {
+				return err
+			}
+			hash, tiers = ml.Hash, ml.TrackerTiers()
+		} else {
+			t, err := torrent.FromFile(args[2])
+			if err != nil {
+				return err
+			}
+			hash, tiers = t.Hash, t.Trackers
+		}
+
+		scraped := 0
+		for _, tier := range tiers {
+			for _, trackerURL := range tier {
+				ctx, cancel := context.WithTimeout(context.Background(), scrapeTimeout)
+				resp, err := tracker.Scrape(ctx, trackerURL, hash)
+				cancel()
+
+				if err != nil {
+					fmt.Printf("%s: error: %v\n", trackerURL, err)
+					continue
+				}
+
+				scraped++
+				fmt.Printf("%s: seeders %d, leechers %d, completed %d\n", trackerURL, resp.Seeders, resp.Leechers, resp.Completed)
+			}
+		}
+
+		if scraped == 0 {
+			return errors.New("no tracker could be scraped")
+		}
 
 		return nil
 	},
@@ -198,13 +489,28 @@ var commands = map[string]func([]string) error{
 		return nil
 	},
 
+	"magnet_link": func(args []string) error {
+		if len(args) != 3 {
+			return errors.New("usage: magnet_link <torrent>")
+		}
+
+		t, err := torrent.FromFile(args[2])
+		if err != nil {
+			return err
+		}
+
+		fmt.Println(t.MagnetLink())
+		return nil
+	},
+
 	"magnet_handshake": func(args []string) error {
 		ml, err := torrent.ParseMagnetLink(args[2])
 		if err != nil {
 			return err
 		}
 
-		peerAddresses, err := peer.FetchAddresses(ml.TrackerURL, ml.Hash, 1)
+		peerAddresses, err := fetchAddresses(ml.TrackerTiers(), ml.Hash, magnetLeft(ml))
+		peerAddresses, err = findMagnetPeers(ml, peerAddresses, err)
 		if err != nil {
 			return err
 		}
@@ -232,35 +538,73 @@ var commands = map[string]func([]string) error{
 			return err
 		}
 
-		peerAddresses, err := peer.FetchAddresses(ml.TrackerURL, ml.Hash, 1)
+		t, err := fetchMetadata(ml)
 		if err != nil {
 			return err
 		}
 
-		client, err := peer.NewClient(peerAddresses[0])
+		fmt.Printf("Tracker URL: %s\n", t.TrackerURL)
+		fmt.Printf("Length: %d\n", t.Length)
+		fmt.Printf("Info Hash: %s\n", hex.EncodeToString(t.Hash[:]))
+		fmt.Printf("Piece Length: %d\n", t.PieceLength)
+		fmt.Println("Piece Hashes:")
+		for _, hash := range t.PieceHashes {
+			fmt.Println(hex.EncodeToString(hash[:]))
+		}
+
+		if t.IsMultiFile() {
+			fmt.Printf("Name: %s\n", t.Name)
+			fmt.Println("Files:")
+			for _, f := range t.Files {
+				fmt.Printf("%s (%d)\n", filepath.Join(f.Path...), f.Length)
+			}
+		}
+
+		return nil
+	},
+
+	"magnet_to_torrent": func(args []string) error {
+		fs := flag.NewFlagSet("magnet_to_torrent", flag.ContinueOnError)
+		outputFile := fs.String("o", "", "path of the .torrent file to write")
+
+		positional, err := parseFlags(fs, args[2:])
 		if err != nil {
 			return err
 		}
-		defer client.Close()
+		if len(positional) != 1 {
+			return errors.New("usage: magnet_to_torrent [-o <output>] <magnet link>")
+		}
 
-		if err := client.HandshakeWithMetadataExtension(ml.Hash); err != nil {
+		ml, err := torrent.ParseMagnetLink(positional[0])
+		if err != nil {
 			return err
 		}
 
-		metadata, err := client.RequestMetadata()
+		t, err := fetchMetadata(ml)
 		if err != nil {
 			return err
 		}
 
-		fmt.Printf("Tracker URL: %s\n", ml.TrackerURL)
-		fmt.Printf("Length: %d\n", metadata.Length)
-		fmt.Printf("Info Hash: %s\n", hex.EncodeToString(ml.Hash[:]))
-		fmt.Printf("Piece Length: %d\n", metadata.PieceLength)
-		fmt.Println("Piece Hashes:")
-		for _, hash := range metadata.PieceHashes {
-			fmt.Println(hex.EncodeToString(hash[:]))
+		data, err := t.Metainfo()
+		if err != nil {
+			return err
+		}
+
+		// The name comes from peers, so it is only used when it is a plain
+		// local name.
+		if *outputFile == "" {
+			*outputFile = hex.EncodeToString(t.Hash[:]) + ".torrent"
+			if name := filepath.Base(t.Name); filepath.IsLocal(t.Name) && name != "." && name != ".." {
+				*outputFile = name + ".torrent"
+			}
 		}
 
+		if err := os.WriteFile(*outputFile, data, 0o644); err != nil {
+			return err
+		}
+
+		fmt.Printf("Info Hash: %s\n", hex.EncodeToString(t.Hash[:]))
+
 		return nil
 	},
 
@@ -277,7 +621,8 @@ var commands = map[string]func([]string) error{
 			return err
 		}
 
-		peerAddresses, err := peer.FetchAddresses(ml.TrackerURL, ml.Hash, 1)
+		peerAddresses, err := fetchAddresses(ml.TrackerTiers(), ml.Hash, magnetLeft(ml))
+		peerAddresses, err = findMagnetPeers(ml, peerAddresses, err)
 		if err != nil {
 			return err
 		}
@@ -288,24 +633,16 @@ var commands = map[string]func([]string) error{
 		}
 		defer clients.Close()
 
-		if err := clients.HandshakeWithMetadataExtension(ml.Hash); err != nil {
+		if clients, err = clients.HandshakeWithMetadataExtension(ml.Hash); err != nil {
 			return err
 		}
 
-		metadata, err := clients[0].RequestMetadata()
+		t, err := ml.FetchMetadata(clients)
 		if err != nil {
 			return err
 		}
 
-		t := torrent.Torrent{
-			TrackerURL:  ml.TrackerURL,
-			Hash:        ml.Hash,
-			Length:      metadata.Length,
-			PieceLength: metadata.PieceLength,
-			PieceHashes: metadata.PieceHashes,
-		}
-
-		if err := clients.Unchoke(); err != nil {
+		if clients, err = clients.Unchoke(); err != nil {
 			return err
 		}
 
@@ -315,7 +652,7 @@ var commands = map[string]func([]string) error{
 		}
 
 		f, err := os.Create(outputFile)
-		if err != err {
+		if err != nil {
 			return err
 		}
 		defer f.Close()
@@ -335,7 +672,13 @@ var commands = map[string]func([]string) error{
 			return err
 		}
 
-		peerAddresses, err := peer.FetchAddresses(ml.TrackerURL, ml.Hash, 1)
+		stats := torrent.NewStats(magnetLeft(ml))
+		trackers := tracker.NewSession(ml.TrackerTiers(), ml.Hash, 0, stats)
+		defer trackers.Stop()
+		printTrackerWarnings(trackers)
+
+		peerAddresses, err := trackers.Start()
+		peerAddresses, err = findMagnetPeers(ml, peerAddresses, err)
 		if err != nil {
 			return err
 		}
@@ -346,46 +689,367 @@ var commands = map[string]func([]string) error{
 		}
 		defer clients.Close()
 
-		if err := clients.HandshakeWithMetadataExtension(ml.Hash); err != nil {
+		if clients, err = clients.HandshakeWithMetadataExtension(ml.Hash); err != nil {
 			return err
 		}
 
-		metadata, err := clients[0].RequestMetadata()
+		t, err := ml.FetchMetadata(clients)
 		if err != nil {
 			return err
 		}
 
-		t := torrent.Torrent{
-			TrackerURL:  ml.TrackerURL,
-			Hash:        ml.Hash,
-			Length:      metadata.Length,
-			PieceLength: metadata.PieceLength,
-			PieceHashes: metadata.PieceHashes,
+		if clients, err = clients.Unchoke(); err != nil {
+			return err
 		}
 
-		if err := clients.Unchoke(); err != nil {
+		store, err := storage.NewSparseFile(t.StorageFiles(outputFile))
+		if err != nil {
 			return err
 		}
+		defer store.Close()
 
-		data, err := t.Download(clients)
-		if err != nil {
+		opts := torrent.DownloadOptions{
+			ResumeFile: torrent.ResumeFilePath(outputFile),
+			Stats:      stats,
+			Peers:      trackers.Peers(),
+		}
+
+		if err := t.Download(clients, store, opts); err != nil {
 			return err
 		}
+		trackers.Completed()
 
-		f, err := os.Create(outputFile)
-		if err != err {
+		return nil
+	},
+
+	"dht": func(args []string) error {
+		fs := flag.NewFlagSet("dht", flag.ContinueOnError)
+		port := fs.Int("port", dht.DefaultPort, "UDP port to listen on")
+		bootstrap := fs.String("bootstrap", strings.Join(dhtBootstrapNodes(), ","), "comma-separated nodes to join the DHT through, none to start a new network")
+		stateFile := fs.String("state", dhtStateFile(), "file to keep the node ID and routing table in across runs")
+
+		positional, err := parseFlags(fs, args[2:])
+		if err != nil {
 			return err
 		}
-		defer f.Close()
+		if len(positional) != 0 {
+			return errors.New("usage: dht [--port <port>] [--bootstrap <host:port,...>] [--state <file>]")
+		}
 
-		if _, err := f.Write(data); err != nil {
+		var node *dht.Node
+		address := fmt.Sprintf(":%d", *port)
+		if *stateFile != "" {
+			node, err = dht.ListenWithState(address, *stateFile)
+		} else {
+			node, err = dht.Listen(address)
+		}
+		if err != nil {
 			return err
 		}
+		defer closeDHT(node, *stateFile)
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		id := node.ID()
+		fmt.Printf("DHT node %s listening on port %d\n", hex.EncodeToString(id[:]), node.Addr().Port())
+
+		if nodes := splitList(*bootstrap); len(nodes) > 0 || node.NodeCount() > 0 {
+			bootstrapCtx, cancel := context.WithTimeout(ctx, dhtTimeout)
+			err := node.Bootstrap(bootstrapCtx, nodes)
+			cancel()
+			if err != nil && ctx.Err() == nil {
+				fmt.Fprintln(os.Stderr, "could not join the DHT:", err)
+			}
+		}
+
+		// The node keeps answering queries, so that other nodes can join the
+		// DHT through it, until the process is interrupted.
+		<-ctx.Done()
+		fmt.Printf("Leaving the DHT with %d nodes known\n", node.NodeCount())
 
 		return nil
 	},
 }
 
+// fetchAddresses announces us to the trackers of an announce list and returns
+// the addresses of the peers they know about, printing the warning one of them
+// may have sent. Nothing accepts connections, so no port is announced.
+func fetchAddresses(tiers [][]string, hash [20]byte, left int) ([]string, error) {
+	peerAddresses, warning, err := tracker.FetchAddresses(tiers, hash, left, 0)
+	printTrackerWarning(warning)
+	return peerAddresses, err
+}
+
+// magnetLeft returns the length left to download for the torrent of a magnet
+// link. The length is unknown until the metadata is fetched unless the link
+// has it, but trackers need to know that the download is not complete.
+func magnetLeft(ml torrent.MagnetLink) int {
+	return max(ml.Length, 1)
+}
+
+// printTrackerWarnings prints the warnings the trackers of a session send
+// until it stops.
+func printTrackerWarnings(trackers *tracker.Session) {
+	go func() {
+		for warning := range trackers.Warnings() {
+			printTrackerWarning(warning)
+		}
+	}()
+}
+
+func printTrackerWarning(warning string) {
+	if warning != "" {
+		fmt.Fprintln(os.Stderr, "tracker warning:", warning)
+	}
+}
+
+// fetchMetadata finds the peers of the torrent of a magnet link and fetches
+// its metadata from them.
+func fetchMetadata(ml torrent.MagnetLink) (torrent.Torrent, error) {
+	peerAddresses, err := fetchAddresses(ml.TrackerTiers(), ml.Hash, magnetLeft(ml))
+	peerAddresses, err = findMagnetPeers(ml, peerAddresses, err)
+	if err != nil {
+		return torrent.Torrent{}, err
+	}
+
+	clients, err := peer.NewClients(peerAddresses)
+	if err != nil {
+		return torrent.Torrent{}, err
+	}
+	defer clients.Close()
+
+	if clients, err = clients.HandshakeWithMetadataExtension(ml.Hash); err != nil {
+		return torrent.Torrent{}, err
+	}
+
+	return ml.FetchMetadata(clients)
+}
+
+// findMagnetPeers returns the peers listed in a magnet link along with those
+// its trackers returned, and only looks the torrent up in the DHT when there
+// are none.
+func findMagnetPeers(ml torrent.MagnetLink, trackerPeers []string, trackerErr error) ([]string, error) {
+	if len(ml.Peers) == 0 {
+		return findPeers(ml.Hash, false, trackerPeers, trackerErr)
+	}
+
+	peers := append(slices.Clone(ml.Peers), trackerPeers...)
+	slices.Sort(peers)
+	return slices.Compact(peers), nil
+}
+
+// findPeers looks the peers of a torrent up in the DHT when its trackers
+// returned none, so that torrents without working trackers can still be
+// downloaded. Private torrents only get peers from their trackers.
+func findPeers(hash [20]byte, private bool, trackerPeers []string, trackerErr error) ([]string, error) {
+	if len(trackerPeers) > 0 || private {
+		return trackerPeers, trackerErr
+	}
+
+	node, err := listenDHT()
+	if err != nil {
+		return nil, errors.Join(trackerErr, err)
+	}
+	defer closeDHT(node, dhtStateFile())
+
+	ctx, cancel := context.WithTimeout(context.Background(), dhtTimeout)
+	defer cancel()
+
+	if err := node.Bootstrap(ctx, dhtBootstrapNodes()); err != nil {
+		return nil, errors.Join(trackerErr, fmt.Errorf("could not join the DHT: %w", err))
+	}
+
+	peers, err := node.GetPeers(ctx, hash)
+	if err != nil {
+		return nil, errors.Join(trackerErr, err)
+	}
+
+	if len(peers) == 0 {
+		return nil, errors.Join(trackerErr, errors.New("no peer found in the DHT"))
+	}
+
+	return peers, nil
+}
+
+// announceDHT announces that we seed a torrent on port to the DHT, and keeps
+// answering the queries of other nodes until ctx is done.
+func announceDHT(ctx context.Context, hash [20]byte, port int) {
+	node, err := listenDHT()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "could not join the DHT:", err)
+		return
+	}
+	defer closeDHT(node, dhtStateFile())
+
+	bootstrapCtx, cancel := context.WithTimeout(ctx, dhtTimeout)
+	err = node.Bootstrap(bootstrapCtx, dhtBootstrapNodes())
+	cancel()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "could not join the DHT:", err)
+		return
+	}
+
+	for {
+		announceCtx, cancel := context.WithTimeout(ctx, dhtTimeout)
+		_, err := node.Announce(announceCtx, hash, port)
+		cancel()
+		if err != nil && ctx.Err() == nil {
+			fmt.Fprintln(os.Stderr, "could not announce to the DHT:", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(dhtAnnounceInterval):
+		}
+	}
+}
+
+// listenDHT opens a DHT node on the default port, or on any port when another
+// process uses it. The node ID and routing table of the previous run are
+// restored from the state file.
+func listenDHT() (*dht.Node, error) {
+	listen := dht.Listen
+	if stateFile := dhtStateFile(); stateFile != "" {
+		listen = func(address string) (*dht.Node, error) {
+			return dht.ListenWithState(address, stateFile)
+		}
+	}
+
+	node, err := listen(fmt.Sprintf(":%d", dht.DefaultPort))
+	if err != nil {
+		node, err = listen(":0")
+	}
+	return node, err
+}
+
+// closeDHT saves the state of a DHT node to stateFile for the next run, unless
+// stateFile is empty, and closes the node.
+func closeDHT(node *dht.Node, stateFile string) {
+	if stateFile != "" {
+		if err := node.SaveState(stateFile); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}
+	node.Close()
+}
+
+// dhtBootstrapNodes returns the nodes to join the DHT through.
+func dhtBootstrapNodes() []string {
+	if nodes, ok := os.LookupEnv(dhtBootstrapEnv); ok {
+		return splitList(nodes)
+	}
+	return dht.DefaultBootstrapNodes
+}
+
+// dhtStateFile returns the file the DHT state is kept in, by default in the
+// user cache directory. It is empty when the state is not to be kept.
+func dhtStateFile() string {
+	if stateFile, ok := os.LookupEnv(dhtStateEnv); ok {
+		return stateFile
+	}
+
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(cacheDir, "mybittorrent", "dht.state")
+}
+
+// serveSeeder starts uploading the pieces of seeder to the peers connecting
+// through l, and returns the channel receiving the error l stops with.
+func serveSeeder(seeder *torrent.Seeder, l *peer.Listener) <-chan error {
+	seeder.Seed(l)
+
+	served := make(chan error, 1)
+	go func() {
+		served <- l.Serve()
+	}()
+
+	return served
+}
+
+// seedTorrent keeps uploading a torrent, served by serveSeeder, until the
+// process is interrupted.
+func seedTorrent(t torrent.Torrent, seeder *torrent.Seeder, l *peer.Listener, served <-chan error) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+
+	dhtDone := make(chan struct{})
+	if t.Private {
+		close(dhtDone)
+	} else {
+		go func() {
+			defer close(dhtDone)
+			announceDHT(ctx, t.Hash, l.Port())
+		}()
+	}
+
+	fmt.Printf("Seeding %d/%d pieces on port %d\n", seeder.Bitfield().Count(), len(t.PieceHashes), l.Port())
+
+	err := <-served
+
+	// The DHT node saves its state when leaving, which is waited for.
+	stop()
+	<-dhtDone
+
+	return err
+}
+
+// tiersFlag collects the tiers of an announce list, one comma-separated list
+// of tracker URLs per occurrence of the flag.
+type tiersFlag [][]string
+
+func (f *tiersFlag) String() string {
+	return fmt.Sprint(*f)
+}
+
+func (f *tiersFlag) Set(value string) error {
+	tier := splitList(value)
+	if len(tier) == 0 {
+		return errors.New("empty tracker tier")
+	}
+
+	*f = append(*f, tier)
+	return nil
+}
+
+// splitList splits a comma-separated list, skipping empty items.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// parseFlags parses args with fs, allowing flags to be interleaved with
+// positional arguments, and returns the positional arguments.
+func parseFlags(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+
+		if fs.NArg() == 0 {
+			return positional, nil
+		}
+
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
 func Run(args []string) error {
 	cmdKey := os.Args[1]
 	if commands[cmdKey] == nil {
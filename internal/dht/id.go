@@ -0,0 +1,43 @@
+package dht
+
+import (
+	"bytes"
+	"crypto/rand"
+	"math/bits"
+)
+
+// ID identifies a node, or the info hash of a torrent, in the DHT key space.
+type ID [20]byte
+
+func RandomID() ID {
+	var id ID
+	if _, err := rand.Read(id[:]); err != nil {
+		panic(err)
+	}
+	return id
+}
+
+// distance returns the XOR distance between two IDs.
+func (id ID) distance(other ID) ID {
+	var d ID
+	for i := range id {
+		d[i] = id[i] ^ other[i]
+	}
+	return d
+}
+
+// closer reports whether a is closer to id than b.
+func (id ID) closer(a, b ID) bool {
+	da, db := id.distance(a), id.distance(b)
+	return bytes.Compare(da[:], db[:]) < 0
+}
+
+// commonPrefixLen returns the number of leading bits two IDs share.
+func commonPrefixLen(a, b ID) int {
+	for i := range a {
+		if x := a[i] ^ b[i]; x != 0 {
+			return i*8 + bits.LeadingZeros8(x)
+		}
+	}
+	return len(a) * 8
+}
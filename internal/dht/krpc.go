@@ -0,0 +1,149 @@
+package dht
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/bencode"
+)
+
+// KRPC error codes.
+const (
+	errorGeneric       = 201
+	errorServer        = 202
+	errorProtocol      = 203
+	errorMethodUnknown = 204
+)
+
+const compactNodeLength = 26
+
+// message is a KRPC message: a query, a response or an error, as told by y.
+type message struct {
+	t string
+	y string
+	q string
+	a map[string]interface{}
+	r map[string]interface{}
+	e []interface{}
+}
+
+func (m message) encode() ([]byte, error) {
+	dict := map[string]interface{}{"t": m.t, "y": m.y}
+
+	switch m.y {
+	case "q":
+		dict["q"] = m.q
+		dict["a"] = m.a
+	case "r":
+		dict["r"] = m.r
+	case "e":
+		dict["e"] = m.e
+	}
+
+	return bencode.Encode(dict)
+}
+
+func parseMessage(data []byte) (message, error) {
+	obj, err := bencode.Decode(data)
+	if err != nil {
+		return message{}, fmt.Errorf("could not decode KRPC message: %w", err)
+	}
+
+	dict, ok := obj.(map[string]interface{})
+	if !ok {
+		return message{}, errors.New("KRPC message is not a dictionary")
+	}
+
+	var m message
+	m.t, _ = dict["t"].(string)
+	m.y, _ = dict["y"].(string)
+
+	switch m.y {
+	case "q":
+		m.q, _ = dict["q"].(string)
+		if m.a, ok = dict["a"].(map[string]interface{}); !ok {
+			return message{}, errors.New("KRPC query has no arguments")
+		}
+	case "r":
+		if m.r, ok = dict["r"].(map[string]interface{}); !ok {
+			return message{}, errors.New("KRPC response has no values")
+		}
+	case "e":
+		m.e, _ = dict["e"].([]interface{})
+	default:
+		return message{}, fmt.Errorf("unexpected KRPC message type: %q", m.y)
+	}
+
+	return m, nil
+}
+
+// Error is an error returned by a remote node.
+type Error struct {
+	Code    int
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("DHT node error %d: %s", e.Code, e.Message)
+}
+
+func parseError(e []interface{}) *Error {
+	err := &Error{Code: errorGeneric}
+	if len(e) > 0 {
+		err.Code, _ = e[0].(int)
+	}
+	if len(e) > 1 {
+		err.Message, _ = e[1].(string)
+	}
+	return err
+}
+
+// argID returns the 20-byte ID stored under key in a KRPC dictionary.
+func argID(dict map[string]interface{}, key string) (ID, bool) {
+	s, ok := dict[key].(string)
+	if !ok || len(s) != len(ID{}) {
+		return ID{}, false
+	}
+	return ID([]byte(s)), true
+}
+
+// encodeNodes returns the compact node info of contacts: the ID, IPv4 address
+// and port of each. Contacts with an IPv6 address are skipped.
+func encodeNodes(contacts []contact) string {
+	b := make([]byte, 0, len(contacts)*compactNodeLength)
+	for _, c := range contacts {
+		if !c.addr.Addr().Is4() {
+			continue
+		}
+		b = append(b, c.id[:]...)
+		b = append(b, encodeAddr(c.addr)...)
+	}
+	return string(b)
+}
+
+func parseNodes(s string) []contact {
+	var contacts []contact
+	for i := 0; i+compactNodeLength <= len(s); i += compactNodeLength {
+		addr := parseAddr(s[i+20 : i+compactNodeLength])
+		if !addr.IsValid() || addr.Port() == 0 {
+			continue
+		}
+		contacts = append(contacts, contact{id: ID([]byte(s[i : i+20])), addr: addr})
+	}
+	return contacts
+}
+
+// encodeAddr returns the compact form of an IPv4 address and port.
+func encodeAddr(addr netip.AddrPort) string {
+	ip := addr.Addr().As4()
+	return string(binary.BigEndian.AppendUint16(ip[:], addr.Port()))
+}
+
+func parseAddr(s string) netip.AddrPort {
+	if len(s) != 6 {
+		return netip.AddrPort{}
+	}
+	return netip.AddrPortFrom(netip.AddrFrom4([4]byte([]byte(s[:4]))), binary.BigEndian.Uint16([]byte(s[4:])))
+}
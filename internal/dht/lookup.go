@@ -0,0 +1,271 @@
+package dht
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"slices"
+	"sync"
+)
+
+// alpha is the number of queries in flight during a lookup.
+const alpha = 3
+
+var errNoNodes = errors.New("no DHT node known")
+
+type lookupNode struct {
+	contact
+	queried   bool
+	responded bool
+	failed    bool
+	token     string
+}
+
+type lookupResult struct {
+	// nodes are the closest nodes to the target that responded, the closest
+	// first.
+	nodes []lookupNode
+	// peers are the peers found when looking up an info hash.
+	peers []netip.AddrPort
+}
+
+// lookup iteratively queries the nodes closest to target, asking each of them
+// for nodes closer still, until the closest nodes known have all been
+// queried. q is either find_node or get_peers.
+func (n *Node) lookup(ctx context.Context, target ID, q string) (lookupResult, error) {
+	targetKey := "target"
+	if q == "get_peers" {
+		targetKey = "info_hash"
+	}
+
+	candidates := map[netip.AddrPort]*lookupNode{}
+	for _, c := range n.table.closest(target, bucketSize) {
+		candidates[c.addr] = &lookupNode{contact: c}
+	}
+
+	if len(candidates) == 0 {
+		return lookupResult{}, errNoNodes
+	}
+
+	type response struct {
+		node *lookupNode
+		r    map[string]interface{}
+		err  error
+	}
+
+	responses := make(chan response)
+	inFlight := 0
+	var peers []netip.AddrPort
+	seenPeers := map[netip.AddrPort]bool{}
+
+	for {
+		for _, node := range closestLookupNodes(candidates, target) {
+			if inFlight >= alpha {
+				break
+			}
+			if node.queried {
+				continue
+			}
+
+			node.queried = true
+			inFlight++
+			go func(node *lookupNode) {
+				r, err := n.query(ctx, node.addr, q, map[string]interface{}{targetKey: string(target[:])})
+				responses <- response{node, r, err}
+			}(node)
+		}
+
+		if inFlight == 0 {
+			break
+		}
+
+		resp := <-responses
+		inFlight--
+
+		if resp.err != nil {
+			if ctx.Err() != nil || errors.Is(resp.err, net.ErrClosed) {
+				for ; inFlight > 0; inFlight-- {
+					<-responses
+				}
+				return lookupResult{}, resp.err
+			}
+			resp.node.failed = true
+			continue
+		}
+
+		resp.node.responded = true
+		resp.node.token, _ = resp.r["token"].(string)
+
+		nodes, _ := resp.r["nodes"].(string)
+		for _, c := range parseNodes(nodes) {
+			if _, ok := candidates[c.addr]; !ok && c.id != n.id {
+				candidates[c.addr] = &lookupNode{contact: c}
+			}
+		}
+
+		values, _ := resp.r["values"].([]interface{})
+		for _, v := range values {
+			s, _ := v.(string)
+			if addr := parseAddr(s); addr.IsValid() && !seenPeers[addr] {
+				seenPeers[addr] = true
+				peers = append(peers, addr)
+			}
+		}
+	}
+
+	var result lookupResult
+	for _, node := range closestLookupNodes(candidates, target) {
+		if node.responded {
+			result.nodes = append(result.nodes, *node)
+		}
+	}
+	result.peers = peers
+
+	return result, nil
+}
+
+// closestLookupNodes returns the bucketSize candidates closest to target that
+// did not fail to respond, which are the only ones worth querying.
+func closestLookupNodes(candidates map[netip.AddrPort]*lookupNode, target ID) []*lookupNode {
+	nodes := make([]*lookupNode, 0, len(candidates))
+	for _, node := range candidates {
+		if !node.failed {
+			nodes = append(nodes, node)
+		}
+	}
+
+	slices.SortFunc(nodes, func(a, b *lookupNode) int {
+		if target.closer(a.id, b.id) {
+			return -1
+		}
+		if target.closer(b.id, a.id) {
+			return 1
+		}
+		return 0
+	})
+
+	return nodes[:min(len(nodes), bucketSize)]
+}
+
+// Bootstrap joins the DHT through the nodes restored from a state file, or
+// through the nodes at addrs when none of them responds, then looks up our own
+// ID to fill the routing table with the nodes close to us.
+func (n *Node) Bootstrap(ctx context.Context, addrs []string) error {
+	var restored []netip.AddrPort
+	for _, c := range n.table.contacts() {
+		restored = append(restored, c.addr)
+	}
+
+	// Restored nodes that do not respond are forgotten right away rather than
+	// after several failed queries, as they were last seen in a previous run.
+	unresponsive := n.pingAll(ctx, restored)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	for _, addr := range unresponsive {
+		n.table.remove(addr)
+	}
+
+	if n.table.len() == 0 {
+		var resolved []netip.AddrPort
+		for _, a := range addrs {
+			addr, err := net.ResolveUDPAddr("udp4", a)
+			if err == nil {
+				resolved = append(resolved, addr.AddrPort())
+			}
+		}
+		n.pingAll(ctx, resolved)
+	}
+
+	if n.table.len() == 0 {
+		return errNoNodes
+	}
+
+	_, err := n.lookup(ctx, n.id, "find_node")
+	return err
+}
+
+// pingAll pings the nodes at addrs at once and returns those that did not
+// respond.
+func (n *Node) pingAll(ctx context.Context, addrs []netip.AddrPort) []netip.AddrPort {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var unresponsive []netip.AddrPort
+
+	for _, addr := range addrs {
+		wg.Add(1)
+		go func(addr netip.AddrPort) {
+			defer wg.Done()
+
+			if n.Ping(ctx, addr) != nil {
+				mu.Lock()
+				unresponsive = append(unresponsive, addr)
+				mu.Unlock()
+			}
+		}(addr)
+	}
+	wg.Wait()
+
+	return unresponsive
+}
+
+// GetPeers looks up the peers of a torrent.
+func (n *Node) GetPeers(ctx context.Context, infoHash [20]byte) ([]string, error) {
+	result, err := n.lookup(ctx, infoHash, "get_peers")
+	if err != nil {
+		return nil, err
+	}
+
+	return addrStrings(result.peers), nil
+}
+
+// Announce looks up the peers of a torrent and announces to the nodes closest
+// to its info hash that we accept connections for it on port.
+func (n *Node) Announce(ctx context.Context, infoHash [20]byte, port int) ([]string, error) {
+	result, err := n.lookup(ctx, infoHash, "get_peers")
+	if err != nil {
+		return nil, err
+	}
+
+	var wg sync.WaitGroup
+	announced := 0
+	var mu sync.Mutex
+
+	for _, node := range result.nodes {
+		if node.token == "" {
+			continue
+		}
+
+		wg.Add(1)
+		go func(node lookupNode) {
+			defer wg.Done()
+
+			_, err := n.query(ctx, node.addr, "announce_peer", map[string]interface{}{
+				"info_hash": string(infoHash[:]),
+				"port":      port,
+				"token":     node.token,
+			})
+			if err == nil {
+				mu.Lock()
+				announced++
+				mu.Unlock()
+			}
+		}(node)
+	}
+	wg.Wait()
+
+	if announced == 0 {
+		return nil, errors.New("no DHT node accepted the announce")
+	}
+
+	return addrStrings(result.peers), nil
+}
+
+func addrStrings(addrs []netip.AddrPort) []string {
+	s := make([]string, len(addrs))
+	for i, addr := range addrs {
+		s[i] = addr.String()
+	}
+	return s
+}
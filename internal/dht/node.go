@@ -0,0 +1,285 @@
+package dht
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultPort = 6881
+
+	// queryTimeout is how long to wait for the response to a query.
+	queryTimeout = 5 * time.Second
+
+	maxPacketSize = 64 * 1024
+)
+
+// DefaultBootstrapNodes are well-known nodes to join the DHT through.
+var DefaultBootstrapNodes = []string{
+	"router.bittorrent.com:6881",
+	"dht.transmissionbt.com:6881",
+	"router.utorrent.com:6881",
+}
+
+var errQueryTimeout = errors.New("DHT node did not respond")
+
+// Node is a node of the mainline DHT (BEP 5). It answers the queries of other
+// nodes for as long as it is open, and looks up the peers of torrents.
+type Node struct {
+	id     ID
+	conn   *net.UDPConn
+	table  *table
+	tokens *tokens
+	peers  *peerStore
+
+	mu      sync.Mutex
+	pending map[string]chan message
+	nextTID uint16
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// Listen opens a node with a random ID on a UDP address and starts answering
+// queries.
+func Listen(address string) (*Node, error) {
+	return ListenWithID(address, RandomID())
+}
+
+// ListenWithID opens a node with the given ID on a UDP address and starts
+// answering queries.
+func ListenWithID(address string, id ID) (*Node, error) {
+	addr, err := net.ResolveUDPAddr("udp4", address)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.ListenUDP("udp4", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	n := &Node{
+		id:      id,
+		conn:    conn,
+		table:   newTable(id),
+		tokens:  newTokens(),
+		peers:   newPeerStore(),
+		pending: map[string]chan message{},
+		closed:  make(chan struct{}),
+	}
+
+	go n.readLoop()
+
+	return n, nil
+}
+
+func (n *Node) ID() ID {
+	return n.id
+}
+
+// Addr returns the UDP address the node listens on.
+func (n *Node) Addr() netip.AddrPort {
+	return n.conn.LocalAddr().(*net.UDPAddr).AddrPort()
+}
+
+// NodeCount returns the number of nodes in the routing table.
+func (n *Node) NodeCount() int {
+	return n.table.len()
+}
+
+func (n *Node) Close() error {
+	var err error
+	n.closeOnce.Do(func() {
+		close(n.closed)
+		err = n.conn.Close()
+	})
+	return err
+}
+
+func (n *Node) readLoop() {
+	buf := make([]byte, maxPacketSize)
+
+	for {
+		size, addr, err := n.conn.ReadFromUDPAddrPort(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			continue
+		}
+
+		m, err := parseMessage(buf[:size])
+		if err != nil {
+			continue
+		}
+
+		addr = netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())
+
+		switch m.y {
+		case "q":
+			n.handleQuery(addr, m)
+		default:
+			n.mu.Lock()
+			ch := n.pending[m.t]
+			delete(n.pending, m.t)
+			n.mu.Unlock()
+
+			if ch != nil {
+				ch <- m
+			}
+		}
+	}
+}
+
+func (n *Node) handleQuery(addr netip.AddrPort, m message) {
+	id, ok := argID(m.a, "id")
+	if !ok {
+		n.sendError(addr, m.t, errorProtocol, "invalid node ID")
+		return
+	}
+
+	n.table.seen(contact{id: id, addr: addr})
+
+	r := map[string]interface{}{"id": string(n.id[:])}
+
+	switch m.q {
+	case "ping":
+
+	case "find_node":
+		target, ok := argID(m.a, "target")
+		if !ok {
+			n.sendError(addr, m.t, errorProtocol, "invalid target")
+			return
+		}
+		r["nodes"] = encodeNodes(n.table.closest(target, bucketSize))
+
+	case "get_peers":
+		infoHash, ok := argID(m.a, "info_hash")
+		if !ok {
+			n.sendError(addr, m.t, errorProtocol, "invalid info hash")
+			return
+		}
+
+		r["token"] = n.tokens.token(addr.Addr())
+
+		if peers := n.peers.get(infoHash); len(peers) > 0 {
+			values := make([]interface{}, len(peers))
+			for i, p := range peers {
+				values[i] = encodeAddr(p)
+			}
+			r["values"] = values
+		} else {
+			r["nodes"] = encodeNodes(n.table.closest(infoHash, bucketSize))
+		}
+
+	case "announce_peer":
+		infoHash, ok := argID(m.a, "info_hash")
+		if !ok {
+			n.sendError(addr, m.t, errorProtocol, "invalid info hash")
+			return
+		}
+
+		token, _ := m.a["token"].(string)
+		if !n.tokens.valid(token, addr.Addr()) {
+			n.sendError(addr, m.t, errorProtocol, "invalid token")
+			return
+		}
+
+		port := int(addr.Port())
+		if implied, _ := m.a["implied_port"].(int); implied == 0 {
+			if port, ok = m.a["port"].(int); !ok || port <= 0 || port > 65535 {
+				n.sendError(addr, m.t, errorProtocol, "invalid port")
+				return
+			}
+		}
+
+		n.peers.add(infoHash, netip.AddrPortFrom(addr.Addr(), uint16(port)))
+
+	default:
+		n.sendError(addr, m.t, errorMethodUnknown, "method unknown")
+		return
+	}
+
+	n.send(addr, message{t: m.t, y: "r", r: r})
+}
+
+func (n *Node) sendError(addr netip.AddrPort, t string, code int, msg string) {
+	n.send(addr, message{t: t, y: "e", e: []interface{}{code, msg}})
+}
+
+func (n *Node) send(addr netip.AddrPort, m message) error {
+	data, err := m.encode()
+	if err != nil {
+		return err
+	}
+
+	_, err = n.conn.WriteToUDPAddrPort(data, addr)
+	return err
+}
+
+// query sends a query to the node at addr and returns its response. The node
+// is added to the routing table when it responds, and marked as failing when
+// it does not.
+func (n *Node) query(ctx context.Context, addr netip.AddrPort, q string, args map[string]interface{}) (map[string]interface{}, error) {
+	args["id"] = string(n.id[:])
+
+	ch := make(chan message, 1)
+
+	n.mu.Lock()
+	n.nextTID++
+	t := string(binary.BigEndian.AppendUint16(nil, n.nextTID))
+	n.pending[t] = ch
+	n.mu.Unlock()
+
+	defer func() {
+		n.mu.Lock()
+		delete(n.pending, t)
+		n.mu.Unlock()
+	}()
+
+	if err := n.send(addr, message{t: t, y: "q", q: q, a: args}); err != nil {
+		return nil, fmt.Errorf("could not send DHT query: %w", err)
+	}
+
+	timer := time.NewTimer(queryTimeout)
+	defer timer.Stop()
+
+	select {
+	case m := <-ch:
+		if m.y == "e" {
+			return nil, parseError(m.e)
+		}
+
+		id, ok := argID(m.r, "id")
+		if !ok {
+			return nil, errors.New("DHT response has no node ID")
+		}
+		n.table.seen(contact{id: id, addr: addr})
+
+		return m.r, nil
+
+	case <-timer.C:
+		n.table.failed(addr)
+		return nil, errQueryTimeout
+
+	case <-ctx.Done():
+		return nil, ctx.Err()
+
+	case <-n.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Ping checks that the node at addr responds, adding it to the routing table
+// if it does.
+func (n *Node) Ping(ctx context.Context, addr netip.AddrPort) error {
+	_, err := n.query(ctx, addr, "ping", map[string]interface{}{})
+	return err
+}
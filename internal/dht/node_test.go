@@ -0,0 +1,124 @@
+package dht
+
+import (
+	"context"
+	"net"
+	"slices"
+	"testing"
+	"time"
+)
+
+// startCluster starts n nodes on loopback, every node but the first joining
+// the DHT through the first.
+func startCluster(t *testing.T, n int) []*Node {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var nodes []*Node
+	for i := 0; i < n; i++ {
+		node, err := ListenWithID("127.0.0.1:0", RandomID())
+		if err != nil {
+			t.Fatalf("could not start node %d: %v", i, err)
+		}
+		t.Cleanup(func() { node.Close() })
+		nodes = append(nodes, node)
+
+		if i == 0 {
+			continue
+		}
+
+		if err := node.Bootstrap(ctx, []string{nodes[0].Addr().String()}); err != nil {
+			t.Fatalf("node %d could not join the DHT: %v", i, err)
+		}
+	}
+
+	return nodes
+}
+
+func TestPing(t *testing.T) {
+	nodes := startCluster(t, 2)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := nodes[0].Ping(ctx, nodes[1].Addr()); err != nil {
+		t.Fatalf("ping failed: %v", err)
+	}
+}
+
+func TestFindNode(t *testing.T) {
+	nodes := startCluster(t, 5)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// The last node joined after node 1, which finds it by asking the others.
+	target := nodes[4]
+	result, err := nodes[1].lookup(ctx, target.ID(), "find_node")
+	if err != nil {
+		t.Fatalf("lookup failed: %v", err)
+	}
+
+	if !slices.ContainsFunc(result.nodes, func(n lookupNode) bool { return n.id == target.ID() }) {
+		t.Fatalf("lookup of %x did not find the node", target.ID())
+	}
+
+	for i, node := range nodes {
+		if node.NodeCount() == 0 {
+			t.Errorf("node %d has an empty routing table", i)
+		}
+	}
+}
+
+func TestAnnounceAndGetPeers(t *testing.T) {
+	nodes := startCluster(t, 5)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	infoHash := RandomID()
+
+	peers, err := nodes[4].GetPeers(ctx, infoHash)
+	if err != nil {
+		t.Fatalf("get_peers failed: %v", err)
+	}
+	if len(peers) != 0 {
+		t.Fatalf("got peers %v before any announce", peers)
+	}
+
+	if _, err := nodes[2].Announce(ctx, infoHash, 6881); err != nil {
+		t.Fatalf("announce_peer failed: %v", err)
+	}
+
+	peers, err = nodes[4].GetPeers(ctx, infoHash)
+	if err != nil {
+		t.Fatalf("get_peers failed: %v", err)
+	}
+	if !slices.Contains(peers, "127.0.0.1:6881") {
+		t.Fatalf("got peers %v, want 127.0.0.1:6881", peers)
+	}
+}
+
+func TestMalformedPacket(t *testing.T) {
+	nodes := startCluster(t, 2)
+
+	conn, err := net.DialUDP("udp4", nil, net.UDPAddrFromAddrPort(nodes[0].Addr()))
+	if err != nil {
+		t.Fatalf("could not dial node: %v", err)
+	}
+	defer conn.Close()
+
+	// A string declaring a length far past the end of the packet.
+	if _, err := conn.Write([]byte("d1:t1000000000000000:e")); err != nil {
+		t.Fatalf("could not send packet: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := nodes[1].Ping(ctx, nodes[0].Addr()); err != nil {
+		t.Fatalf("ping after malformed packet failed: %v", err)
+	}
+}
@@ -0,0 +1,80 @@
+package dht
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/atomicfile"
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/bencode"
+)
+
+// ListenWithState opens a node on a UDP address with the ID and routing table
+// saved to stateFile by SaveState. A node with a random ID and an empty
+// routing table is opened when there is no usable state file.
+func ListenWithState(address, stateFile string) (*Node, error) {
+	id, contacts, err := readState(stateFile)
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := ListenWithID(address, id)
+	if err != nil {
+		return nil, err
+	}
+
+	n.table.restore(contacts)
+
+	return n, nil
+}
+
+// SaveState writes the node ID and the nodes of the routing table that
+// responded to their last query to stateFile, so that the next run can join
+// the DHT through them instead of the bootstrap nodes.
+func (n *Node) SaveState(stateFile string) error {
+	data, err := bencode.Encode(map[string]interface{}{
+		"id":    string(n.id[:]),
+		"nodes": encodeNodes(n.table.good()),
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(stateFile), 0o755); err != nil {
+		return fmt.Errorf("could not write DHT state file: %w", err)
+	}
+
+	if err := atomicfile.WriteFile(stateFile, data, 0o644); err != nil {
+		return fmt.Errorf("could not write DHT state file: %w", err)
+	}
+
+	return nil
+}
+
+func readState(stateFile string) (ID, []contact, error) {
+	data, err := os.ReadFile(stateFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return RandomID(), nil, nil
+	}
+	if err != nil {
+		return ID{}, nil, fmt.Errorf("could not read DHT state file: %w", err)
+	}
+
+	// A state file in an unexpected shape is ignored and the node starts
+	// afresh.
+	obj, err := bencode.Decode(data)
+	if err != nil {
+		return RandomID(), nil, nil
+	}
+
+	dict, _ := obj.(map[string]interface{})
+	id, ok := argID(dict, "id")
+	if !ok {
+		return RandomID(), nil, nil
+	}
+
+	nodes, _ := dict["nodes"].(string)
+
+	return id, parseNodes(nodes), nil
+}
@@ -0,0 +1,134 @@
+package dht
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	mrand "math/rand/v2"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+const (
+	// tokenRotation is how often the secret tokens are derived from changes.
+	// Tokens remain valid until the secret changes twice.
+	tokenRotation = 5 * time.Minute
+	// peerTTL is how long an announced peer is handed out without being
+	// announced again.
+	peerTTL = 30 * time.Minute
+	// maxPeersPerTorrent bounds the peers stored for a torrent.
+	maxPeersPerTorrent = 500
+	// maxValues bounds the peers returned in a get_peers response, so that it
+	// fits in a UDP packet.
+	maxValues = 50
+)
+
+// tokens hands out the tokens required to announce a peer, which prove that
+// the announcing node owns its IP address.
+type tokens struct {
+	mu        sync.Mutex
+	secrets   [2][20]byte
+	rotatedAt time.Time
+}
+
+func newTokens() *tokens {
+	t := &tokens{rotatedAt: time.Now()}
+	rand.Read(t.secrets[0][:])
+	t.secrets[1] = t.secrets[0]
+	return t
+}
+
+func (t *tokens) rotate() {
+	if time.Since(t.rotatedAt) < tokenRotation {
+		return
+	}
+
+	t.secrets[1] = t.secrets[0]
+	rand.Read(t.secrets[0][:])
+	t.rotatedAt = time.Now()
+}
+
+func (t *tokens) token(addr netip.Addr) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.rotate()
+	return tokenFor(t.secrets[0], addr)
+}
+
+func (t *tokens) valid(token string, addr netip.Addr) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.rotate()
+	for _, secret := range t.secrets {
+		if hmac.Equal([]byte(token), []byte(tokenFor(secret, addr))) {
+			return true
+		}
+	}
+	return false
+}
+
+func tokenFor(secret [20]byte, addr netip.Addr) string {
+	ip := addr.AsSlice()
+	sum := sha1.Sum(append(secret[:], ip...))
+	return string(sum[:8])
+}
+
+// peerStore holds the peers announced to us, by info hash.
+type peerStore struct {
+	mu    sync.Mutex
+	peers map[ID]map[netip.AddrPort]time.Time
+}
+
+func newPeerStore() *peerStore {
+	return &peerStore{peers: map[ID]map[netip.AddrPort]time.Time{}}
+}
+
+func (s *peerStore) add(infoHash ID, addr netip.AddrPort) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.expire(infoHash)
+
+	peers := s.peers[infoHash]
+	if peers == nil {
+		peers = map[netip.AddrPort]time.Time{}
+		s.peers[infoHash] = peers
+	}
+
+	if _, ok := peers[addr]; ok || len(peers) < maxPeersPerTorrent {
+		peers[addr] = time.Now()
+	}
+}
+
+// get returns up to maxValues peers of a torrent, picked at random.
+func (s *peerStore) get(infoHash ID) []netip.AddrPort {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.expire(infoHash)
+
+	var addrs []netip.AddrPort
+	for addr := range s.peers[infoHash] {
+		addrs = append(addrs, addr)
+	}
+
+	mrand.Shuffle(len(addrs), func(i, j int) { addrs[i], addrs[j] = addrs[j], addrs[i] })
+	return addrs[:min(len(addrs), maxValues)]
+}
+
+// expire forgets the peers of a torrent that were not announced for too
+// long. It must be called with s.mu held.
+func (s *peerStore) expire(infoHash ID) {
+	for addr, announcedAt := range s.peers[infoHash] {
+		if time.Since(announcedAt) > peerTTL {
+			delete(s.peers[infoHash], addr)
+		}
+	}
+
+	if len(s.peers[infoHash]) == 0 {
+		delete(s.peers, infoHash)
+	}
+}
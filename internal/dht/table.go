@@ -0,0 +1,194 @@
+package dht
+
+import (
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// bucketSize is the number of nodes kept per bucket, k in Kademlia.
+	bucketSize = 8
+	// maxNodeFailures is the number of queries in a row a node may fail to
+	// respond to before it is removed from the routing table.
+	maxNodeFailures = 3
+)
+
+type contact struct {
+	id   ID
+	addr netip.AddrPort
+}
+
+type tableEntry struct {
+	contact
+	lastSeen time.Time
+	failures int
+}
+
+// table is the routing table of a node. Nodes are kept in a bucket per length
+// of the prefix they share with our ID, so that we know many nodes close to us
+// and a few far away. Each bucket is ordered from the least to the most
+// recently seen node.
+type table struct {
+	self ID
+
+	mu      sync.Mutex
+	buckets [len(ID{}) * 8][]*tableEntry
+}
+
+func newTable(self ID) *table {
+	return &table{self: self}
+}
+
+// seen records that a node responded to us or queried us. It is added to its
+// bucket if there is room, or in place of a node that failed to respond.
+func (t *table) seen(c contact) {
+	if c.id == t.self || !c.addr.IsValid() {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	i := commonPrefixLen(t.self, c.id)
+	bucket := t.buckets[i]
+
+	if j := slices.IndexFunc(bucket, func(e *tableEntry) bool { return e.id == c.id }); j >= 0 {
+		e := bucket[j]
+		e.addr = c.addr
+		e.lastSeen = time.Now()
+		e.failures = 0
+		t.buckets[i] = append(slices.Delete(bucket, j, j+1), e)
+		return
+	}
+
+	e := &tableEntry{contact: c, lastSeen: time.Now()}
+
+	if len(bucket) < bucketSize {
+		t.buckets[i] = append(bucket, e)
+		return
+	}
+
+	// Good nodes are never replaced, since nodes that stayed around for long
+	// are the likeliest to stay longer.
+	worst := -1
+	for j, o := range bucket {
+		if o.failures > 0 && (worst < 0 || o.failures > bucket[worst].failures) {
+			worst = j
+		}
+	}
+	if worst >= 0 {
+		t.buckets[i] = append(slices.Delete(bucket, worst, worst+1), e)
+	}
+}
+
+// failed records that the node at addr did not respond to a query, and
+// removes it once it failed too many times.
+func (t *table) failed(addr netip.AddrPort) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for i, bucket := range t.buckets {
+		for j, e := range bucket {
+			if e.addr != addr {
+				continue
+			}
+
+			e.failures++
+			if e.failures >= maxNodeFailures {
+				t.buckets[i] = slices.Delete(bucket, j, j+1)
+			}
+			return
+		}
+	}
+}
+
+// remove removes the node at addr from the routing table.
+func (t *table) remove(addr netip.AddrPort) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for i, bucket := range t.buckets {
+		t.buckets[i] = slices.DeleteFunc(bucket, func(e *tableEntry) bool { return e.addr == addr })
+	}
+}
+
+// closest returns up to n known nodes, the closest to target first.
+func (t *table) closest(target ID, n int) []contact {
+	contacts := t.contacts()
+
+	slices.SortFunc(contacts, func(a, b contact) int {
+		if target.closer(a.id, b.id) {
+			return -1
+		}
+		if target.closer(b.id, a.id) {
+			return 1
+		}
+		return 0
+	})
+
+	return contacts[:min(n, len(contacts))]
+}
+
+func (t *table) contacts() []contact {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var contacts []contact
+	for _, bucket := range t.buckets {
+		for _, e := range bucket {
+			contacts = append(contacts, e.contact)
+		}
+	}
+	return contacts
+}
+
+// good returns the nodes that responded to their last query.
+func (t *table) good() []contact {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var contacts []contact
+	for _, bucket := range t.buckets {
+		for _, e := range bucket {
+			if e.failures == 0 {
+				contacts = append(contacts, e.contact)
+			}
+		}
+	}
+	return contacts
+}
+
+// restore adds nodes saved by a previous run to their bucket when there is
+// room. They are not marked as seen, since they may well have gone away since.
+func (t *table) restore(contacts []contact) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, c := range contacts {
+		if c.id == t.self || !c.addr.IsValid() {
+			continue
+		}
+
+		i := commonPrefixLen(t.self, c.id)
+		bucket := t.buckets[i]
+		if len(bucket) >= bucketSize || slices.ContainsFunc(bucket, func(e *tableEntry) bool { return e.id == c.id }) {
+			continue
+		}
+
+		// Restored nodes go first, as the least recently seen.
+		t.buckets[i] = append([]*tableEntry{{contact: c}}, bucket...)
+	}
+}
+
+func (t *table) len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	n := 0
+	for _, bucket := range t.buckets {
+		n += len(bucket)
+	}
+	return n
+}
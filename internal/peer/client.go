@@ -4,26 +4,189 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/bitfield"
+)
+
+const (
+	// readTimeout closes connections to peers that stay silent for longer than
+	// twice the keep-alive interval.
+	readTimeout       = 4 * time.Minute
+	keepAliveInterval = 2 * time.Minute
+	eventBufferSize   = 64
+
+	dialTimeout      = 5 * time.Second
+	handshakeTimeout = 10 * time.Second
+	// responseTimeout bounds how long we wait for the peer to answer a
+	// message, such as an unchoke after we declared interest.
+	responseTimeout = 30 * time.Second
 )
 
+// State holds the choke and interest flags of both sides of a connection.
+type State struct {
+	AmChoking      bool
+	AmInterested   bool
+	PeerChoking    bool
+	PeerInterested bool
+}
+
+type EventType int
+
+const (
+	ChokeEvent EventType = iota
+	UnchokeEvent
+	InterestedEvent
+	NotInterestedEvent
+	HaveEvent
+	BitfieldEvent
+	RequestEvent
+	PieceEvent
+	CancelEvent
+	ExtendedEvent
+	ExtensionHandshakeEvent
+	PEXEvent
+	MetadataEvent
+	MetadataRejectEvent
+)
+
+// Event is a message received from the peer. Only the fields relevant to its
+// type are set: Index for have, Bitfield for bitfield, Index, Begin and Length
+// for request and cancel, Index, Begin and Data for piece, ExtendedID and Data
+// for extended messages, Peers for the peers added by a peer exchange message,
+// and Index for metadata pieces, along with Data and the size of the metadata
+// as Length when the piece was sent.
+type Event struct {
+	Type       EventType
+	Index      int
+	Begin      int
+	Length     int
+	Data       []byte
+	Bitfield   bitfield.Bitfield
+	ExtendedID byte
+	Peers      []PEXPeer
+}
+
 type Client struct {
-	conn                   net.Conn
-	peerID                 [20]byte
-	withExtensionSupport   bool
-	metadataExtensionID    byte
-	bitfieldMessageWasRead bool
+	conn                 net.Conn
+	peerID               [20]byte
+	withExtensionSupport bool
+	// extensions are the extensions we advertised.
+	extensions *Extensions
+
+	writeMu   sync.Mutex
+	lastWrite time.Time
+
+	mu       sync.Mutex
+	state    State
+	bitfield bitfield.Bitfield
+	// hasBitfield is set once the peer sent its bitfield.
+	hasBitfield bool
+	// pieceCount is the number of pieces of the torrent, or 0 until set.
+	pieceCount int
+	err        error
+	// extensionHandshake is the extension handshake of the peer.
+	extensionHandshake ExtensionHandshake
+
+	events    chan Event
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newClient(conn net.Conn) *Client {
+	return &Client{
+		conn:   conn,
+		state:  State{AmChoking: true, PeerChoking: true},
+		events: make(chan Event, eventBufferSize),
+		done:   make(chan struct{}),
+	}
 }
 
 func (c *Client) PeerID() [20]byte {
 	return c.peerID
 }
 
+// Addr returns the address of the peer.
+func (c *Client) Addr() string {
+	return c.conn.RemoteAddr().String()
+}
+
 func (c *Client) MetadataExtensionID() byte {
-	return c.metadataExtensionID
+	return c.peerExtensionID(MetadataExtension)
+}
+
+func (c *Client) State() State {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.state
+}
+
+// HasPiece reports whether the peer announced it has a piece, either in its
+// bitfield or with a have message.
+func (c *Client) HasPiece(index int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.bitfield.Has(index)
+}
+
+// SetPieceCount sets the number of pieces of the torrent, past which the
+// pieces the peer announces are rejected.
+func (c *Client) SetPieceCount(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pieceCount = n
+}
+
+// pieceLimit returns the number of pieces past which the pieces the peer
+// announces are rejected: the number of pieces of the torrent when set, the
+// length of the bitfield of the peer when it sent one, and otherwise the most
+// pieces an info dictionary of MaxMetadataSize can list.
+func (c *Client) pieceLimit() int {
+	switch {
+	case c.pieceCount > 0:
+		return c.pieceCount
+	case c.hasBitfield:
+		return len(c.bitfield) * 8
+	default:
+		return MaxMetadataSize / 20
+	}
+}
+
+// PieceCount returns how many pieces the peer announced it has.
+func (c *Client) PieceCount() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.bitfield.Count()
+}
+
+// HasAnnouncedPieces reports whether the peer told which pieces it has, with
+// its bitfield or a have message.
+func (c *Client) HasAnnouncedPieces() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hasBitfield || len(c.bitfield) > 0
+}
+
+// Events returns the messages received from the peer once the handshake is
+// done. The channel is closed when the connection fails or is closed, after
+// which Err reports why.
+func (c *Client) Events() <-chan Event {
+	return c.events
+}
+
+func (c *Client) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
 }
 
 func (c *Client) Close() error {
-	return c.conn.Close()
+	c.closeOnce.Do(func() {
+		close(c.done)
+	})
+	c.fail(net.ErrClosed)
+	return nil
 }
 
 func (c *Client) Handshake(hash [20]byte) error {
@@ -31,74 +194,84 @@ func (c *Client) Handshake(hash [20]byte) error {
 }
 
 func (c *Client) HandshakeWithMetadataExtension(hash [20]byte) error {
-	if err := c.handshake(hash, true); err != nil {
-		return err
-	}
+	e := NewExtensions()
+	e.Register(MetadataExtension, MetadataHandler)
 
-	if err := c.readBitfieldMessage(); err != nil {
+	if err := c.HandshakeWithExtensions(hash, e); err != nil {
 		return err
 	}
 
-	if err := c.writeMessage(&extensionHandshakeMessage{metadataExtensionID: 1}); err != nil {
-		return err
+	if !c.withExtensionSupport {
+		return errors.New("client does not support extensions")
 	}
 
-	var msg extensionHandshakeMessage
-	if err := c.readMessage(&msg); err != nil {
+	if _, err := c.waitFor(func(ev Event) bool { return ev.Type == ExtensionHandshakeEvent }); err != nil {
 		return err
 	}
 
-	c.metadataExtensionID = msg.metadataExtensionID
+	if c.MetadataExtensionID() == 0 {
+		return errors.New("client does not support the metadata extension")
+	}
 
 	return nil
 }
 
-type RequestMetadataOutput struct {
-	PieceLength int
-	Length      int
-	PieceHashes [][20]byte
-}
-
-func (c *Client) RequestMetadata() (RequestMetadataOutput, error) {
-	if err := c.writeMessage(&metadataRequestMessage{metadataExtensionID: c.metadataExtensionID}); err != nil {
-		return RequestMetadataOutput{}, err
+// Unchoke declares interest in the peer and waits until it unchokes us.
+func (c *Client) Unchoke() error {
+	if err := c.SetInterested(true); err != nil {
+		return err
 	}
 
-	var msg metadataDataMessage
-	if err := c.readMessage(&msg); err != nil {
-		return RequestMetadataOutput{}, err
+	if !c.State().PeerChoking {
+		return nil
 	}
 
-	return RequestMetadataOutput{PieceLength: msg.pieceLength, Length: msg.length, PieceHashes: msg.pieceHashes}, nil
+	_, err := c.waitFor(func(ev Event) bool { return ev.Type == UnchokeEvent })
+	return err
 }
 
-func (c *Client) readBitfieldMessage() error {
-	if c.bitfieldMessageWasRead {
+// SetInterested tells the peer whether we want to download from it. Nothing
+// is sent when the state does not change.
+func (c *Client) SetInterested(interested bool) error {
+	c.mu.Lock()
+	changed := c.state.AmInterested != interested
+	c.state.AmInterested = interested
+	c.mu.Unlock()
+
+	if !changed {
 		return nil
 	}
 
-	if err := c.readMessage(&bitfieldMessage{}); err != nil {
-		return err
+	if interested {
+		return c.writeMessage(&interestedMessage{})
 	}
-
-	c.bitfieldMessageWasRead = true
-	return nil
+	return c.writeMessage(&notInterestedMessage{})
 }
 
-func (c *Client) Unchoke() error {
-	if err := c.readBitfieldMessage(); err != nil {
-		return err
-	}
+// SetChoking tells the peer whether we refuse to upload to it. Nothing is
+// sent when the state does not change.
+func (c *Client) SetChoking(choking bool) error {
+	c.mu.Lock()
+	changed := c.state.AmChoking != choking
+	c.state.AmChoking = choking
+	c.mu.Unlock()
 
-	if err := c.writeMessage(&interestedMessage{}); err != nil {
-		return err
+	if !changed {
+		return nil
 	}
 
-	if err := c.readMessage(&unchokeMessage{}); err != nil {
-		return err
+	if choking {
+		return c.writeMessage(&chokeMessage{})
 	}
+	return c.writeMessage(&unchokeMessage{})
+}
 
-	return nil
+func (c *Client) SendBitfield(b bitfield.Bitfield) error {
+	return c.writeMessage(&bitfieldMessage{bitfield: b})
+}
+
+func (c *Client) SendHave(index int) error {
+	return c.writeMessage(&haveMessage{index: index})
 }
 
 type RequestPieceInput struct {
@@ -111,29 +284,59 @@ func (c *Client) RequestPiece(input RequestPieceInput) error {
 	return c.writeMessage(&requestMessage{index: input.Index, begin: input.Begin, length: input.Length})
 }
 
-type ReadPieceOutput struct {
-	Index int
-	Begin int
-	Data  []byte
+func (c *Client) CancelPiece(input RequestPieceInput) error {
+	return c.writeMessage(&requestMessage{cancel: true, index: input.Index, begin: input.Begin, length: input.Length})
 }
 
-func (c *Client) ReadPiece() (ReadPieceOutput, error) {
-	var msg pieceMessage
-	if err := c.readMessage(&msg); err != nil {
-		return ReadPieceOutput{}, err
-	}
-	return ReadPieceOutput{Index: msg.index, Begin: msg.begin, Data: msg.data}, nil
+func (c *Client) SendPiece(index, begin int, data []byte) error {
+	return c.writeMessage(&pieceMessage{index: index, begin: begin, data: data})
 }
 
 func (c *Client) writeMessage(m messageWriter) error {
-	return m.write(c.conn)
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if err := m.write(c.conn); err != nil {
+		c.fail(err)
+		return err
+	}
+
+	c.lastWrite = time.Now()
+	return nil
 }
 
 func (c *Client) readMessage(m messageReader) error {
 	return m.read(c.conn)
 }
 
+// waitFor consumes events until one matches, dropping the others. The state
+// they carry is still tracked by the client. It gives up after
+// responseTimeout.
+func (c *Client) waitFor(match func(Event) bool) (Event, error) {
+	timer := time.NewTimer(responseTimeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case ev, ok := <-c.events:
+			if !ok {
+				return Event{}, c.Err()
+			}
+			if match(ev) {
+				return ev, nil
+			}
+
+		case <-timer.C:
+			return Event{}, errors.New("timed out waiting for peer")
+		}
+	}
+}
+
 func (c *Client) handshake(hash [20]byte, withExtensionSupport bool) error {
+	if err := c.conn.SetDeadline(time.Now().Add(handshakeTimeout)); err != nil {
+		return err
+	}
+
 	if err := c.writeMessage(&handshakeMessage{peerID: peerID(), hash: hash, withExtensionSupport: withExtensionSupport}); err != nil {
 		return err
 	}
@@ -144,22 +347,183 @@ func (c *Client) handshake(hash [20]byte, withExtensionSupport bool) error {
 	}
 
 	c.peerID = handshake.peerID
-	c.withExtensionSupport = handshake.withExtensionSupport
+	c.withExtensionSupport = withExtensionSupport && handshake.withExtensionSupport
 
-	if withExtensionSupport && withExtensionSupport != handshake.withExtensionSupport {
-		return errors.New("client does not support extensions")
+	if err := c.conn.SetDeadline(time.Time{}); err != nil {
+		return err
 	}
 
+	c.start()
+
 	return nil
 }
 
+// start runs the loops that read the peer's messages and keep the connection
+// alive. It must be called once, after the handshake.
+func (c *Client) start() {
+	go c.readLoop()
+	go c.keepAliveLoop()
+}
+
+func (c *Client) readLoop() {
+	defer close(c.events)
+
+	for {
+		if err := c.conn.SetReadDeadline(time.Now().Add(readTimeout)); err != nil {
+			c.fail(err)
+			return
+		}
+
+		var pm peerMessage
+		if err := pm.read(c.conn); err != nil {
+			c.fail(err)
+			return
+		}
+
+		var ev Event
+		var ok bool
+		var err error
+		if pm.id == extendedMessageID && !pm.keepAlive {
+			ev, ok, err = c.handleExtendedMessage(pm.payload)
+		} else {
+			ev, ok, err = c.handleMessage(pm)
+		}
+		if err != nil {
+			c.fail(err)
+			return
+		}
+
+		if !ok {
+			continue
+		}
+
+		select {
+		case c.events <- ev:
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// handleMessage updates the connection state from a message and returns the
+// event to report for it, if any.
+func (c *Client) handleMessage(pm peerMessage) (Event, bool, error) {
+	if pm.keepAlive {
+		return Event{}, false, nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch pm.id {
+	case chokeMessageID:
+		c.state.PeerChoking = true
+		return Event{Type: ChokeEvent}, true, nil
+
+	case unchokeMessageID:
+		c.state.PeerChoking = false
+		return Event{Type: UnchokeEvent}, true, nil
+
+	case interestedMessageID:
+		c.state.PeerInterested = true
+		return Event{Type: InterestedEvent}, true, nil
+
+	case notInterestedMessageID:
+		c.state.PeerInterested = false
+		return Event{Type: NotInterestedEvent}, true, nil
+
+	case haveMessageID:
+		var msg haveMessage
+		if err := msg.decode(pm); err != nil {
+			return Event{}, false, err
+		}
+		if msg.index >= c.pieceLimit() {
+			return Event{}, false, fmt.Errorf("peer announced piece %d out of range", msg.index)
+		}
+		// Without a bitfield from the peer, the bitfield grows to fit the
+		// pieces it announces.
+		if missing := msg.index/8 + 1 - len(c.bitfield); missing > 0 {
+			c.bitfield = append(c.bitfield, make(bitfield.Bitfield, missing)...)
+		}
+		c.bitfield.Set(msg.index)
+		return Event{Type: HaveEvent, Index: msg.index}, true, nil
+
+	case bitfieldMessageID:
+		var msg bitfieldMessage
+		if err := msg.decode(pm); err != nil {
+			return Event{}, false, err
+		}
+		c.bitfield = append(bitfield.Bitfield(nil), msg.bitfield...)
+		c.hasBitfield = true
+		return Event{Type: BitfieldEvent, Bitfield: msg.bitfield}, true, nil
+
+	case requestMessageID, cancelMessageID:
+		var msg requestMessage
+		if err := msg.decode(pm); err != nil {
+			return Event{}, false, err
+		}
+		evType := RequestEvent
+		if msg.cancel {
+			evType = CancelEvent
+		}
+		return Event{Type: evType, Index: msg.index, Begin: msg.begin, Length: msg.length}, true, nil
+
+	case pieceMessageID:
+		var msg pieceMessage
+		if err := msg.decode(pm); err != nil {
+			return Event{}, false, err
+		}
+		return Event{Type: PieceEvent, Index: msg.index, Begin: msg.begin, Data: msg.data}, true, nil
+
+	default:
+		// Messages from extensions we do not support, such as the DHT port
+		// message, are ignored.
+		return Event{}, false, nil
+	}
+}
+
+func (c *Client) keepAliveLoop() {
+	ticker := time.NewTicker(keepAliveInterval / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+
+		case <-ticker.C:
+			c.writeMu.Lock()
+			idle := time.Since(c.lastWrite) >= keepAliveInterval
+			c.writeMu.Unlock()
+
+			if idle {
+				if err := c.writeMessage(&peerMessage{keepAlive: true}); err != nil {
+					return
+				}
+			}
+		}
+	}
+}
+
+// fail records the first error that broke the connection and closes it so
+// that both loops stop.
+func (c *Client) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err == nil {
+		c.err = err
+		c.conn.Close()
+	}
+}
+
 func NewClient(peerAddress string) (*Client, error) {
-	conn, err := net.Dial("tcp", peerAddress)
+	conn, err := net.DialTimeout("tcp", peerAddress, dialTimeout)
 	if err != nil {
 		return nil, fmt.Errorf("could not connect to peer address %s: %w", peerAddress, err)
 	}
 
-	return &Client{conn: conn}, nil
+	return newClient(conn), nil
 }
 
 type Clients []*Client
@@ -170,42 +534,106 @@ func (s Clients) Close() {
 	}
 }
 
-func (s Clients) Handshake(hash [20]byte) error {
+// Availability returns how many of the clients have each of numPieces pieces.
+func (s Clients) Availability(numPieces int) []int {
+	availability := make([]int, numPieces)
 	for _, c := range s {
-		if err := c.Handshake(hash); err != nil {
-			return err
+		for i := range availability {
+			if c.HasPiece(i) {
+				availability[i]++
+			}
 		}
 	}
-	return nil
+	return availability
 }
 
-func (s Clients) HandshakeWithMetadataExtension(hash [20]byte) error {
-	for _, c := range s {
-		if err := c.HandshakeWithMetadataExtension(hash); err != nil {
-			return err
-		}
-	}
-	return nil
+// Handshake performs the handshake with every client and returns those that
+// succeeded. The others are closed.
+func (s Clients) Handshake(hash [20]byte) (Clients, error) {
+	return s.filter(func(c *Client) error { return c.Handshake(hash) })
 }
 
-func (s Clients) Unchoke() error {
-	for _, c := range s {
-		if err := c.Unchoke(); err != nil {
-			return err
+// HandshakeWithExtensions performs the handshake with every client,
+// advertising the extensions of e to those supporting the extension protocol,
+// and returns those that succeeded. The others are closed.
+func (s Clients) HandshakeWithExtensions(hash [20]byte, e *Extensions) (Clients, error) {
+	return s.filter(func(c *Client) error { return c.HandshakeWithExtensions(hash, e) })
+}
+
+// HandshakeWithMetadataExtension performs the handshake and the extension
+// handshake with every client and returns those that succeeded. The others
+// are closed.
+func (s Clients) HandshakeWithMetadataExtension(hash [20]byte) (Clients, error) {
+	return s.filter(func(c *Client) error { return c.HandshakeWithMetadataExtension(hash) })
+}
+
+// Unchoke waits for every client to unchoke us and returns those that did. The
+// others are closed.
+func (s Clients) Unchoke() (Clients, error) {
+	return s.filter(func(c *Client) error { return c.Unchoke() })
+}
+
+// filter runs fn on every client concurrently and returns the clients it
+// succeeded for, closing the others. It only fails when no client is left.
+func (s Clients) filter(fn func(*Client) error) (Clients, error) {
+	errs := make([]error, len(s))
+	var wg sync.WaitGroup
+
+	for i, c := range s {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = fn(c)
+		}()
+	}
+	wg.Wait()
+
+	var ok Clients
+	for i, c := range s {
+		if errs[i] != nil {
+			c.Close()
+			continue
 		}
+		ok = append(ok, c)
 	}
-	return nil
+
+	if len(ok) == 0 {
+		return nil, fmt.Errorf("no peer left: %w", errors.Join(errs...))
+	}
+
+	return ok, nil
 }
 
+// NewClients connects to every peer address and returns the clients of those
+// that could be reached. It only fails when none could.
 func NewClients(peerAddresses []string) (Clients, error) {
-	clients := Clients(make([]*Client, 0, len(peerAddresses)))
-	for _, address := range peerAddresses {
-		client, err := NewClient(address)
-		if err != nil {
-			clients.Close()
-			return nil, err
+	if len(peerAddresses) == 0 {
+		return nil, errors.New("no peer addresses")
+	}
+
+	clients := make(Clients, len(peerAddresses))
+	errs := make([]error, len(peerAddresses))
+	var wg sync.WaitGroup
+
+	for i, address := range peerAddresses {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			clients[i], errs[i] = NewClient(address)
+		}()
+	}
+	wg.Wait()
+
+	var connected Clients
+	for _, c := range clients {
+		if c != nil {
+			connected = append(connected, c)
 		}
-		clients = append(clients, client)
 	}
-	return clients, nil
+
+	if len(connected) == 0 {
+		return nil, fmt.Errorf("could not connect to any peer: %w", errors.Join(errs...))
+	}
+
+	return connected, nil
 }
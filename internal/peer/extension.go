@@ -0,0 +1,296 @@
+package peer
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/bencode"
+)
+
+// Names of the extensions of the extension protocol (BEP 10) we support.
+const (
+	MetadataExtension = "ut_metadata"
+	PEXExtension      = "ut_pex"
+)
+
+const (
+	// clientVersion is the client name and version advertised to peers.
+	clientVersion = "mybittorrent"
+	// requestQueueLength is the number of outstanding requests we advertise
+	// accepting from a peer.
+	requestQueueLength = 250
+)
+
+// ExtensionHandler handles the messages a peer sends for an extension. It is
+// called from the goroutine reading the messages of the peer, and returns the
+// event to report for the message, if any.
+type ExtensionHandler func(c *Client, payload []byte) (Event, bool, error)
+
+// Extensions is a registry of the extensions advertised to peers in the
+// extension handshake. It must not be modified once used in a handshake.
+type Extensions struct {
+	// Port is advertised as the port we accept connections on, unless 0.
+	Port int
+	// MetadataSize is advertised as the size of the info dictionary of the
+	// torrent, unless 0.
+	MetadataSize int
+
+	names    []string
+	handlers map[string]ExtensionHandler
+}
+
+func NewExtensions() *Extensions {
+	return &Extensions{handlers: map[string]ExtensionHandler{}}
+}
+
+// Register registers the handler of the messages of an extension. A nil
+// handler reports them as ExtendedEvents. Extensions are assigned IDs in the
+// order they are registered.
+func (e *Extensions) Register(name string, handler ExtensionHandler) {
+	if _, ok := e.handlers[name]; !ok {
+		e.names = append(e.names, name)
+	}
+	e.handlers[name] = handler
+}
+
+// ID returns the ID peers send the messages of an extension with, or 0 when
+// it is not registered.
+func (e *Extensions) ID(name string) byte {
+	if e == nil {
+		return 0
+	}
+
+	for i, n := range e.names {
+		if n == name {
+			return byte(i + 1)
+		}
+	}
+	return 0
+}
+
+// handler returns the name and the handler of the extension whose messages are
+// sent with id.
+func (e *Extensions) handler(id byte) (string, ExtensionHandler, bool) {
+	if e == nil || id == 0 || int(id) > len(e.names) {
+		return "", nil, false
+	}
+
+	name := e.names[id-1]
+	return name, e.handlers[name], true
+}
+
+// ExtensionHandshake is the extension handshake of a peer.
+type ExtensionHandshake struct {
+	// Extensions maps the names of the extensions the peer supports to the
+	// IDs to send their messages with.
+	Extensions map[string]byte
+	// Client is the name and version of the client of the peer.
+	Client string
+	// Port is the port the peer accepts connections on, or 0.
+	Port int
+	// RequestQueueLength is the number of outstanding requests the peer
+	// accepts, or 0.
+	RequestQueueLength int
+	// YourIP is our IP address as seen by the peer.
+	YourIP netip.Addr
+	// MetadataSize is the size of the info dictionary of the torrent, or 0.
+	MetadataSize int
+}
+
+// HandshakeWithExtensions performs the handshake with the extension protocol
+// bit set and, when the peer set it too, sends the extension handshake
+// advertising the extensions of e. The extension handshake of the peer is
+// reported as an ExtensionHandshakeEvent, and the messages of the extensions
+// are passed to their handler.
+func (c *Client) HandshakeWithExtensions(hash [20]byte, e *Extensions) error {
+	c.extensions = e
+
+	if err := c.handshake(hash, true); err != nil {
+		return err
+	}
+
+	if !c.withExtensionSupport {
+		return nil
+	}
+
+	return c.sendExtensionHandshake()
+}
+
+// ExtensionHandshake returns the extension handshake of the peer, which is
+// empty until it has been received.
+func (c *Client) ExtensionHandshake() ExtensionHandshake {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.extensionHandshake
+}
+
+// SupportsExtension reports whether the peer advertised an extension in its
+// extension handshake.
+func (c *Client) SupportsExtension(name string) bool {
+	return c.peerExtensionID(name) != 0
+}
+
+// SendExtended sends a message of an extension, with the ID the peer asked
+// for.
+func (c *Client) SendExtended(name string, payload []byte) error {
+	id := c.peerExtensionID(name)
+	if id == 0 {
+		return fmt.Errorf("peer does not support the %s extension", name)
+	}
+
+	return c.writeMessage(&peerMessage{id: extendedMessageID, payload: append([]byte{id}, payload...)})
+}
+
+// peerExtensionID returns the ID the peer wants the messages of an extension
+// to be sent with, or 0 when it does not support the extension.
+func (c *Client) peerExtensionID(name string) byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.extensionHandshake.Extensions[name]
+}
+
+func (c *Client) sendExtensionHandshake() error {
+	h := ExtensionHandshake{
+		Extensions:         map[string]byte{},
+		Client:             clientVersion,
+		RequestQueueLength: requestQueueLength,
+	}
+
+	if c.extensions != nil {
+		for _, name := range c.extensions.names {
+			h.Extensions[name] = c.extensions.ID(name)
+		}
+		h.Port = c.extensions.Port
+		h.MetadataSize = c.extensions.MetadataSize
+	}
+
+	if addr, ok := c.conn.RemoteAddr().(*net.TCPAddr); ok {
+		h.YourIP = addr.AddrPort().Addr().Unmap()
+	}
+
+	return c.writeMessage(&extensionHandshakeMessage{handshake: h})
+}
+
+// handleExtendedMessage handles an extended message, either the extension
+// handshake of the peer or the message of an extension, which is routed to its
+// handler by the ID we assigned to it.
+func (c *Client) handleExtendedMessage(payload []byte) (Event, bool, error) {
+	if len(payload) == 0 {
+		return Event{}, false, errors.New("empty extended message")
+	}
+	id, data := payload[0], payload[1:]
+
+	if id == 0 {
+		var msg extensionHandshakeMessage
+		if err := msg.decode(data); err != nil {
+			return Event{}, false, fmt.Errorf("could not decode extension handshake: %w", err)
+		}
+
+		c.mu.Lock()
+		c.extensionHandshake = msg.handshake
+		c.mu.Unlock()
+
+		return Event{Type: ExtensionHandshakeEvent}, true, nil
+	}
+
+	// Messages of extensions we did not advertise are ignored.
+	name, handler, ok := c.extensions.handler(id)
+	if !ok {
+		return Event{}, false, nil
+	}
+
+	if handler == nil {
+		return Event{Type: ExtendedEvent, ExtendedID: id, Data: data}, true, nil
+	}
+
+	ev, ok, err := handler(c, data)
+	if err != nil {
+		return Event{}, false, fmt.Errorf("could not handle %s message: %w", name, err)
+	}
+	return ev, ok, nil
+}
+
+type extensionHandshakeMessage struct {
+	handshake ExtensionHandshake
+}
+
+func (m *extensionHandshakeMessage) write(w io.Writer) error {
+	ids := map[string]interface{}{}
+	for name, id := range m.handshake.Extensions {
+		ids[name] = int(id)
+	}
+
+	dict := map[string]interface{}{"m": ids}
+	if m.handshake.Client != "" {
+		dict["v"] = m.handshake.Client
+	}
+	if m.handshake.Port != 0 {
+		dict["p"] = m.handshake.Port
+	}
+	if m.handshake.RequestQueueLength != 0 {
+		dict["reqq"] = m.handshake.RequestQueueLength
+	}
+	if m.handshake.YourIP.IsValid() {
+		dict["yourip"] = string(m.handshake.YourIP.AsSlice())
+	}
+	if m.handshake.MetadataSize != 0 {
+		dict["metadata_size"] = m.handshake.MetadataSize
+	}
+
+	dictEncoded, err := bencode.Encode(dict)
+	if err != nil {
+		return err
+	}
+
+	pm := peerMessage{id: extendedMessageID, payload: append([]byte{0}, dictEncoded...)}
+	return pm.write(w)
+}
+
+func (m *extensionHandshakeMessage) decode(payload []byte) error {
+	p, err := bencode.Decode(payload)
+	if err != nil {
+		return err
+	}
+
+	dict, ok := p.(map[string]interface{})
+	if !ok {
+		return errors.New("invalid extension handshake")
+	}
+
+	// Every key is optional, and those in an unexpected shape are ignored.
+	// Extensions with ID 0 are disabled by the peer.
+	h := ExtensionHandshake{Extensions: map[string]byte{}}
+
+	ids, _ := dict["m"].(map[string]interface{})
+	for name, id := range ids {
+		if id, ok := id.(int); ok && id > 0 && id <= 255 {
+			h.Extensions[name] = byte(id)
+		}
+	}
+
+	h.Client, _ = dict["v"].(string)
+
+	if port, ok := dict["p"].(int); ok && port > 0 && port <= 65535 {
+		h.Port = port
+	}
+
+	if reqq, ok := dict["reqq"].(int); ok && reqq > 0 {
+		h.RequestQueueLength = reqq
+	}
+
+	if ip, ok := dict["yourip"].(string); ok && (len(ip) == 4 || len(ip) == 16) {
+		addr, _ := netip.AddrFromSlice([]byte(ip))
+		h.YourIP = addr.Unmap()
+	}
+
+	if size, ok := dict["metadata_size"].(int); ok && size > 0 {
+		h.MetadataSize = size
+	}
+
+	m.handshake = h
+
+	return nil
+}
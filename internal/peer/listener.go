@@ -0,0 +1,113 @@
+package peer
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultPort = 6881
+
+	inboundHandshakeTimeout = 10 * time.Second
+)
+
+// Listener accepts inbound peer connections and hands them to the handler
+// registered for the info hash the remote peer asks for.
+type Listener struct {
+	ln       net.Listener
+	mu       sync.Mutex
+	handlers map[[20]byte]handler
+}
+
+type handler struct {
+	extensions *Extensions
+	serve      func(*Client)
+}
+
+func Listen(address string) (*Listener, error) {
+	ln, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Listener{ln: ln, handlers: map[[20]byte]handler{}}, nil
+}
+
+func (l *Listener) Port() int {
+	return l.ln.Addr().(*net.TCPAddr).Port
+}
+
+// HandleWithExtensions registers the handler of connections for a torrent,
+// advertising the extensions of e to the peers supporting the extension
+// protocol. The connection is closed when the handler returns.
+func (l *Listener) HandleWithExtensions(hash [20]byte, e *Extensions, serve func(*Client)) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.handlers[hash] = handler{extensions: e, serve: serve}
+}
+
+// Serve accepts connections until the listener is closed.
+func (l *Listener) Serve() error {
+	for {
+		conn, err := l.ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		go l.accept(conn)
+	}
+}
+
+func (l *Listener) Close() error {
+	return l.ln.Close()
+}
+
+func (l *Listener) accept(conn net.Conn) {
+	defer conn.Close()
+
+	if err := conn.SetDeadline(time.Now().Add(inboundHandshakeTimeout)); err != nil {
+		return
+	}
+
+	var handshake handshakeMessage
+	if err := handshake.read(conn); err != nil {
+		return
+	}
+
+	l.mu.Lock()
+	h, ok := l.handlers[handshake.hash]
+	l.mu.Unlock()
+
+	if !ok {
+		return
+	}
+
+	withExtensionSupport := h.extensions != nil && handshake.withExtensionSupport
+	if err := (&handshakeMessage{peerID: peerID(), hash: handshake.hash, withExtensionSupport: withExtensionSupport}).write(conn); err != nil {
+		return
+	}
+
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		return
+	}
+
+	c := newClient(conn)
+	c.peerID = handshake.peerID
+	c.withExtensionSupport = withExtensionSupport
+	c.extensions = h.extensions
+	c.start()
+	defer c.Close()
+
+	if withExtensionSupport {
+		if err := c.sendExtensionHandshake(); err != nil {
+			return
+		}
+	}
+
+	h.serve(c)
+}
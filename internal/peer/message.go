@@ -5,7 +5,7 @@ import (
 	"fmt"
 	"io"
 
-	"github.com/codecrafters-io/bittorrent-starter-go/internal/bencode"
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/bitfield"
 )
 
 type message interface {
@@ -58,75 +58,90 @@ func (m *handshakeMessage) read(r io.Reader) error {
 	return nil
 }
 
-type bitfieldMessage struct{}
+const (
+	chokeMessageID         byte = 0
+	unchokeMessageID       byte = 1
+	interestedMessageID    byte = 2
+	notInterestedMessageID byte = 3
+	haveMessageID          byte = 4
+	bitfieldMessageID      byte = 5
+	requestMessageID       byte = 6
+	pieceMessageID         byte = 7
+	cancelMessageID        byte = 8
+	extendedMessageID      byte = 20
+)
 
-func (m *bitfieldMessage) read(r io.Reader) error {
-	var pm peerMessage
-	if err := pm.read(r); err != nil {
-		return err
-	}
-	return verifyMessageID(pm, 5)
+// maxMessageLength bounds the payload accepted from a peer. It fits a 128 KiB
+// block as well as the bitfield of a torrent with a million pieces.
+const maxMessageLength = 1 << 20
+
+type bitfieldMessage struct {
+	bitfield bitfield.Bitfield
 }
 
-type interestedMessage struct{}
+func (m *bitfieldMessage) decode(pm peerMessage) error {
+	m.bitfield = bitfield.Bitfield(pm.payload)
+	return nil
+}
 
-func (m *interestedMessage) write(w io.Writer) error {
-	pm := peerMessage{id: 2}
+func (m *bitfieldMessage) write(w io.Writer) error {
+	pm := peerMessage{id: bitfieldMessageID, payload: m.bitfield}
 	return pm.write(w)
 }
 
-type unchokeMessage struct{}
+type chokeMessage struct{}
 
-func (m *unchokeMessage) read(r io.Reader) error {
-	var pm peerMessage
-	if err := pm.read(r); err != nil {
-		return err
-	}
-	return verifyMessageID(pm, 1)
+func (m *chokeMessage) write(w io.Writer) error {
+	pm := peerMessage{id: chokeMessageID}
+	return pm.write(w)
 }
 
-type extensionHandshakeMessage struct {
-	metadataExtensionID byte
+type unchokeMessage struct{}
+
+func (m *unchokeMessage) write(w io.Writer) error {
+	pm := peerMessage{id: unchokeMessageID}
+	return pm.write(w)
 }
 
-func (m *extensionHandshakeMessage) write(w io.Writer) error {
-	dictEncoded, err := bencode.Encode(map[string]interface{}{"m": map[string]interface{}{"ut_metadata": int(m.metadataExtensionID)}})
-	if err != nil {
-		return err
-	}
-	payload := make([]byte, len(dictEncoded)+1)
-	payload[0] = 0
-	copy(payload[1:], dictEncoded)
+type interestedMessage struct{}
 
-	pm := peerMessage{id: 20, payload: payload}
+func (m *interestedMessage) write(w io.Writer) error {
+	pm := peerMessage{id: interestedMessageID}
 	return pm.write(w)
 }
 
-func (m *extensionHandshakeMessage) read(r io.Reader) error {
-	var pm peerMessage
-	if err := pm.read(r); err != nil {
-		return err
-	}
+type notInterestedMessage struct{}
 
-	if err := verifyMessageID(pm, 20); err != nil {
-		return err
-	}
+func (m *notInterestedMessage) write(w io.Writer) error {
+	pm := peerMessage{id: notInterestedMessageID}
+	return pm.write(w)
+}
 
-	if pm.payload[0] != 0 {
-		return fmt.Errorf("unexpected extension message id: %v", pm.payload[0])
-	}
+type haveMessage struct {
+	index int
+}
 
-	p, err := bencode.Decode(pm.payload[1:])
-	if err != nil {
-		return err
+func (m *haveMessage) write(w io.Writer) error {
+	var payload [4]byte
+	binary.BigEndian.PutUint32(payload[:], uint32(m.index))
+	pm := peerMessage{id: haveMessageID, payload: payload[:]}
+	return pm.write(w)
+}
+
+func (m *haveMessage) decode(pm peerMessage) error {
+	if len(pm.payload) != 4 {
+		return fmt.Errorf("invalid have message length: %v", len(pm.payload))
 	}
 
-	m.metadataExtensionID = byte(p.(map[string]interface{})["m"].(map[string]interface{})["ut_metadata"].(int))
+	m.index = int(binary.BigEndian.Uint32(pm.payload))
 
 	return nil
 }
 
+// requestMessage is used for both request and cancel messages, which share
+// the same payload.
 type requestMessage struct {
+	cancel bool
 	index  int
 	begin  int
 	length int
@@ -137,24 +152,35 @@ func (m *requestMessage) write(w io.Writer) error {
 	binary.BigEndian.PutUint32(payload[0:], uint32(m.index))
 	binary.BigEndian.PutUint32(payload[4:], uint32(m.begin))
 	binary.BigEndian.PutUint32(payload[8:], uint32(m.length))
-	pm := peerMessage{id: 6, payload: payload[:]}
+	pm := peerMessage{id: requestMessageID, payload: payload[:]}
+	if m.cancel {
+		pm.id = cancelMessageID
+	}
 	return pm.write(w)
 }
 
+func (m *requestMessage) decode(pm peerMessage) error {
+	if len(pm.payload) != 12 {
+		return fmt.Errorf("invalid request message length: %v", len(pm.payload))
+	}
+
+	m.cancel = pm.id == cancelMessageID
+	m.index = int(binary.BigEndian.Uint32(pm.payload))
+	m.begin = int(binary.BigEndian.Uint32(pm.payload[4:]))
+	m.length = int(binary.BigEndian.Uint32(pm.payload[8:]))
+
+	return nil
+}
+
 type pieceMessage struct {
 	index int
 	begin int
 	data  []byte
 }
 
-func (m *pieceMessage) read(r io.Reader) error {
-	var pm peerMessage
-	if err := pm.read(r); err != nil {
-		return err
-	}
-
-	if err := verifyMessageID(pm, 7); err != nil {
-		return err
+func (m *pieceMessage) decode(pm peerMessage) error {
+	if len(pm.payload) < 8 {
+		return fmt.Errorf("invalid piece message length: %v", len(pm.payload))
 	}
 
 	m.index = int(binary.BigEndian.Uint32(pm.payload))
@@ -164,75 +190,29 @@ func (m *pieceMessage) read(r io.Reader) error {
 	return nil
 }
 
-type metadataRequestMessage struct {
-	metadataExtensionID byte
-}
-
-func (m *metadataRequestMessage) write(w io.Writer) error {
-	dictEncoded, err := bencode.Encode(map[string]interface{}{"msg_type": 0, "piece": 0})
-	if err != nil {
-		return err
-	}
-	payload := make([]byte, len(dictEncoded)+1)
-	payload[0] = m.metadataExtensionID
-	copy(payload[1:], dictEncoded)
-
-	pm := peerMessage{id: 20, payload: payload}
+func (m *pieceMessage) write(w io.Writer) error {
+	payload := make([]byte, 8+len(m.data))
+	binary.BigEndian.PutUint32(payload[0:], uint32(m.index))
+	binary.BigEndian.PutUint32(payload[4:], uint32(m.begin))
+	copy(payload[8:], m.data)
+	pm := peerMessage{id: pieceMessageID, payload: payload}
 	return pm.write(w)
 }
 
-type metadataDataMessage struct {
-	metadataExtensionID byte
-	pieceLength         int
-	pieceHashes         [][20]byte
-	length              int
-	name                string
-}
-
-func (m *metadataDataMessage) read(r io.Reader) error {
-	var pm peerMessage
-	if err := pm.read(r); err != nil {
-		return err
-	}
-
-	if err := verifyMessageID(pm, 20); err != nil {
-		return err
-	}
-
-	p, err := bencode.Decode(pm.payload[1:])
-	if err != nil {
-		return err
-	}
-
-	size := p.(map[string]interface{})["total_size"].(int)
-
-	metadata, err := bencode.Decode(pm.payload[len(pm.payload)-size:])
-	if err != nil {
-		return err
-	}
-
-	dict := metadata.(map[string]interface{})
-	rawPieceHashes := dict["pieces"].(string)
-	pieceHashes := make([][20]byte, len(rawPieceHashes)/20)
-	for i := range len(pieceHashes) {
-		copy(pieceHashes[i][:], rawPieceHashes[i*20:])
-	}
-
-	m.pieceLength = dict["piece length"].(int)
-	m.length = dict["length"].(int)
-	m.pieceHashes = pieceHashes
-	m.name = dict["name"].(string)
-	m.metadataExtensionID = pm.payload[0]
-
-	return nil
-}
-
 type peerMessage struct {
 	id      byte
 	payload []byte
+	// keepAlive is set for the zero-length messages peers send to keep an
+	// idle connection open. They have neither an id nor a payload.
+	keepAlive bool
 }
 
 func (m *peerMessage) write(w io.Writer) error {
+	if m.keepAlive {
+		_, err := w.Write([]byte{0, 0, 0, 0})
+		return err
+	}
+
 	length := len(m.payload) + 1
 	buf := make([]byte, length+4)
 	binary.BigEndian.PutUint32(buf, uint32(length))
@@ -250,12 +230,27 @@ func (m *peerMessage) write(w io.Writer) error {
 
 func (m *peerMessage) read(r io.Reader) error {
 	var header [5]byte
-	if _, err := io.ReadFull(r, header[:]); err != nil {
+	if _, err := io.ReadFull(r, header[:4]); err != nil {
 		return fmt.Errorf("could not read peer message header: %w", err)
 	}
 
-	m.id = header[4]
 	length := binary.BigEndian.Uint32(header[:4])
+	if length == 0 {
+		*m = peerMessage{keepAlive: true}
+		return nil
+	}
+
+	if length > maxMessageLength {
+		return fmt.Errorf("peer message too long: %v bytes", length)
+	}
+
+	if _, err := io.ReadFull(r, header[4:]); err != nil {
+		return fmt.Errorf("could not read peer message header: %w", err)
+	}
+
+	m.id = header[4]
+	m.keepAlive = false
+	m.payload = nil
 
 	if length > 1 {
 		m.payload = make([]byte, length-1)
@@ -266,10 +261,3 @@ func (m *peerMessage) read(r io.Reader) error {
 
 	return nil
 }
-
-func verifyMessageID(m peerMessage, id byte) error {
-	if m.id != id {
-		return fmt.Errorf("expected message id %v but got %v", id, m.id)
-	}
-	return nil
-}
@@ -0,0 +1,163 @@
+package peer
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/bencode"
+)
+
+// MetadataPieceSize is the size of the pieces the info dictionary of a torrent
+// is exchanged in with ut_metadata (BEP 9). Only the last piece is shorter.
+const MetadataPieceSize = 16 * 1024
+
+// MaxMetadataSize bounds the size of the info dictionaries exchanged with
+// ut_metadata.
+const MaxMetadataSize = 16 * 1024 * 1024
+
+const (
+	metadataRequest = 0
+	metadataData    = 1
+	metadataReject  = 2
+)
+
+// ErrMetadataRejected is returned when a peer rejects a request for a piece of
+// the info dictionary, usually because it does not have it.
+var ErrMetadataRejected = errors.New("peer rejected the metadata request")
+
+// MetadataHandler is the ExtensionHandler of ut_metadata. It reports the
+// pieces of the info dictionary sent by the peer as MetadataEvents and the
+// rejected requests as MetadataRejectEvents.
+func MetadataHandler(c *Client, payload []byte) (Event, bool, error) {
+	var msg metadataMessage
+	if err := msg.decode(payload); err != nil {
+		return Event{}, false, err
+	}
+
+	// Requests are only answered by ServeMetadata.
+	ev, ok := msg.event()
+	return ev, ok, nil
+}
+
+// ServeMetadata returns the ExtensionHandler of ut_metadata for a torrent
+// whose info dictionary is info. The requests of the peer are answered with
+// the pieces of info, or rejected when info is nil. The pieces received and
+// the rejected requests are reported like MetadataHandler does.
+func ServeMetadata(info []byte) ExtensionHandler {
+	return func(c *Client, payload []byte) (Event, bool, error) {
+		var msg metadataMessage
+		if err := msg.decode(payload); err != nil {
+			return Event{}, false, err
+		}
+
+		if msg.msgType != metadataRequest {
+			ev, ok := msg.event()
+			return ev, ok, nil
+		}
+
+		reply := metadataMessage{msgType: metadataReject, piece: msg.piece}
+		if msg.piece < (len(info)+MetadataPieceSize-1)/MetadataPieceSize {
+			begin := msg.piece * MetadataPieceSize
+			reply = metadataMessage{
+				msgType:   metadataData,
+				piece:     msg.piece,
+				totalSize: len(info),
+				data:      info[begin:min(begin+MetadataPieceSize, len(info))],
+			}
+		}
+
+		replyPayload, err := reply.encode()
+		if err != nil {
+			return Event{}, false, err
+		}
+
+		return Event{}, false, c.SendExtended(MetadataExtension, replyPayload)
+	}
+}
+
+// RequestMetadataPiece requests a piece of the info dictionary of the torrent
+// and returns its data. It fails with ErrMetadataRejected when the peer does
+// not send it.
+func (c *Client) RequestMetadataPiece(piece int) ([]byte, error) {
+	payload, err := (&metadataMessage{msgType: metadataRequest, piece: piece}).encode()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.SendExtended(MetadataExtension, payload); err != nil {
+		return nil, err
+	}
+
+	ev, err := c.waitFor(func(ev Event) bool {
+		return (ev.Type == MetadataEvent || ev.Type == MetadataRejectEvent) && ev.Index == piece
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if ev.Type == MetadataRejectEvent {
+		return nil, ErrMetadataRejected
+	}
+
+	return ev.Data, nil
+}
+
+// metadataMessage is a ut_metadata message: a dictionary followed, for data
+// messages, by the data of the piece.
+type metadataMessage struct {
+	msgType   int
+	piece     int
+	totalSize int
+	data      []byte
+}
+
+// event returns the event reporting a data or reject message.
+func (m *metadataMessage) event() (Event, bool) {
+	switch m.msgType {
+	case metadataData:
+		return Event{Type: MetadataEvent, Index: m.piece, Length: m.totalSize, Data: m.data}, true
+	case metadataReject:
+		return Event{Type: MetadataRejectEvent, Index: m.piece}, true
+	default:
+		return Event{}, false
+	}
+}
+
+func (m *metadataMessage) encode() ([]byte, error) {
+	dict := map[string]interface{}{"msg_type": m.msgType, "piece": m.piece}
+	if m.msgType == metadataData {
+		dict["total_size"] = m.totalSize
+	}
+
+	dictEncoded, err := bencode.Encode(dict)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(dictEncoded, m.data...), nil
+}
+
+func (m *metadataMessage) decode(payload []byte) error {
+	p, n, err := bencode.DecodePrefix(payload)
+	if err != nil {
+		return err
+	}
+
+	dict, ok := p.(map[string]interface{})
+	if !ok {
+		return errors.New("invalid metadata message")
+	}
+
+	if m.msgType, ok = dict["msg_type"].(int); !ok {
+		return errors.New("metadata message has no type")
+	}
+
+	if m.piece, ok = dict["piece"].(int); !ok || m.piece < 0 || m.piece >= MaxMetadataSize/MetadataPieceSize {
+		return fmt.Errorf("invalid metadata piece: %v", dict["piece"])
+	}
+
+	m.totalSize, _ = dict["total_size"].(int)
+	m.data = payload[n:]
+
+	return nil
+}
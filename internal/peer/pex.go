@@ -0,0 +1,162 @@
+package peer
+
+import (
+	"encoding/binary"
+	"errors"
+	"net/netip"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/bencode"
+)
+
+// Flags describing the peers exchanged with ut_pex (BEP 11).
+const (
+	PEXPrefersEncryption byte = 0x01
+	PEXSeed              byte = 0x02
+	PEXSupportsUTP       byte = 0x04
+	PEXSupportsHolepunch byte = 0x08
+	PEXReachable         byte = 0x10
+)
+
+// MaxPEXPeers is the largest number of added or dropped peers a peer exchange
+// message may carry.
+const MaxPEXPeers = 50
+
+// PEXPeer is a peer learned or announced through peer exchange.
+type PEXPeer struct {
+	Addr  string
+	Flags byte
+}
+
+// SupportsPEX reports whether the peer advertised ut_pex in its extension
+// handshake.
+func (c *Client) SupportsPEX() bool {
+	return c.SupportsExtension(PEXExtension)
+}
+
+// SendPEX tells the peer about the peers we connected to and disconnected
+// from since the previous call.
+func (c *Client) SendPEX(added []PEXPeer, dropped []string) error {
+	payload, err := (&pexMessage{added: added, dropped: dropped}).encode()
+	if err != nil {
+		return err
+	}
+
+	return c.SendExtended(PEXExtension, payload)
+}
+
+// PEXHandler is the ExtensionHandler of ut_pex. It reports the peers added by
+// the peer exchange messages of the peer as PEXEvents.
+func PEXHandler(c *Client, payload []byte) (Event, bool, error) {
+	var msg pexMessage
+	if err := msg.decode(payload); err != nil {
+		return Event{}, false, err
+	}
+
+	return Event{Type: PEXEvent, Peers: msg.added[:min(len(msg.added), MaxPEXPeers)]}, true, nil
+}
+
+type pexMessage struct {
+	added   []PEXPeer
+	dropped []string
+}
+
+func (m *pexMessage) encode() ([]byte, error) {
+	var added, addedFlags, added6, added6Flags, dropped, dropped6 []byte
+
+	for _, p := range m.added {
+		addr, err := netip.ParseAddrPort(p.Addr)
+		if err != nil {
+			continue
+		}
+		if addr.Addr().Unmap().Is4() {
+			added = appendCompactAddr(added, addr)
+			addedFlags = append(addedFlags, p.Flags)
+		} else {
+			added6 = appendCompactAddr(added6, addr)
+			added6Flags = append(added6Flags, p.Flags)
+		}
+	}
+
+	for _, a := range m.dropped {
+		addr, err := netip.ParseAddrPort(a)
+		if err != nil {
+			continue
+		}
+		if addr.Addr().Unmap().Is4() {
+			dropped = appendCompactAddr(dropped, addr)
+		} else {
+			dropped6 = appendCompactAddr(dropped6, addr)
+		}
+	}
+
+	return bencode.Encode(map[string]interface{}{
+		"added":    string(added),
+		"added.f":  string(addedFlags),
+		"added6":   string(added6),
+		"added6.f": string(added6Flags),
+		"dropped":  string(dropped),
+		"dropped6": string(dropped6),
+	})
+}
+
+func (m *pexMessage) decode(payload []byte) error {
+	p, err := bencode.Decode(payload)
+	if err != nil {
+		return err
+	}
+
+	dict, ok := p.(map[string]interface{})
+	if !ok {
+		return errors.New("invalid peer exchange message")
+	}
+
+	added, _ := dict["added"].(string)
+	addedFlags, _ := dict["added.f"].(string)
+	added6, _ := dict["added6"].(string)
+	added6Flags, _ := dict["added6.f"].(string)
+	dropped, _ := dict["dropped"].(string)
+	dropped6, _ := dict["dropped6"].(string)
+
+	m.added = append(parsePEXPeers(added, addedFlags, 4), parsePEXPeers(added6, added6Flags, 16)...)
+	m.dropped = nil
+	for _, p := range append(parsePEXPeers(dropped, "", 4), parsePEXPeers(dropped6, "", 16)...) {
+		m.dropped = append(m.dropped, p.Addr)
+	}
+
+	return nil
+}
+
+// parsePEXPeers parses compact peer addresses of ipLength-byte IPs, along with
+// their flags when there is one byte per peer. Peers with a port of 0 are
+// skipped.
+func parsePEXPeers(peers, flags string, ipLength int) []PEXPeer {
+	entryLength := ipLength + 2
+	if len(flags) != len(peers)/entryLength {
+		flags = ""
+	}
+
+	var parsed []PEXPeer
+	for i := 0; (i+1)*entryLength <= len(peers); i++ {
+		entry := []byte(peers[i*entryLength : (i+1)*entryLength])
+
+		ip, _ := netip.AddrFromSlice(entry[:ipLength])
+		port := binary.BigEndian.Uint16(entry[ipLength:])
+		if port == 0 {
+			continue
+		}
+
+		p := PEXPeer{Addr: netip.AddrPortFrom(ip.Unmap(), port).String()}
+		if flags != "" {
+			p.Flags = flags[i]
+		}
+		parsed = append(parsed, p)
+	}
+
+	return parsed
+}
+
+func appendCompactAddr(b []byte, addr netip.AddrPort) []byte {
+	ip := addr.Addr().Unmap()
+	b = append(b, ip.AsSlice()...)
+	return binary.BigEndian.AppendUint16(b, addr.Port())
+}
@@ -0,0 +1,63 @@
+package peer
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+// maxRequestLength is the largest block a peer may ask for. Clients use 16 KiB
+// blocks and the larger requests are refused by most implementations.
+const maxRequestLength = 128 * 1024
+
+// BlockReader provides the pieces uploaded to other peers. The pieces it has
+// may grow while they are served.
+type BlockReader interface {
+	HasPiece(index int) bool
+	ReadBlock(index, begin int, data []byte) error
+}
+
+// Serve uploads pieces from r until the connection is closed. The bitfield of
+// the pieces r has must have been sent already. The peer is unchoked once it
+// declares interest and choked again when it loses it, and requests received
+// while it is choked are dropped.
+func (c *Client) Serve(r BlockReader) error {
+	for ev := range c.Events() {
+		switch ev.Type {
+		case InterestedEvent:
+			if err := c.SetChoking(false); err != nil {
+				return err
+			}
+
+		case NotInterestedEvent:
+			if err := c.SetChoking(true); err != nil {
+				return err
+			}
+
+		case RequestEvent:
+			if c.State().AmChoking || !r.HasPiece(ev.Index) {
+				continue
+			}
+
+			if ev.Length <= 0 || ev.Length > maxRequestLength {
+				return fmt.Errorf("invalid request length: %v", ev.Length)
+			}
+
+			data := make([]byte, ev.Length)
+			if err := r.ReadBlock(ev.Index, ev.Begin, data); err != nil {
+				return err
+			}
+
+			if err := c.SendPiece(ev.Index, ev.Begin, data); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := c.Err(); !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+		return err
+	}
+
+	return nil
+}
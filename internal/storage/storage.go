@@ -0,0 +1,215 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Storage holds torrent data addressed by its offset in the piece space.
+type Storage interface {
+	io.ReaderAt
+	io.WriterAt
+	Close() error
+}
+
+// File is a file backing a contiguous range of the piece space. Files are laid
+// out back to back in the order they are given to a constructor.
+type File struct {
+	Path   string
+	Length int
+}
+
+type fileStorage struct {
+	files   []File
+	offsets []int64
+	length  int64
+	// readOnly storages never create, nor write to, their files.
+	readOnly bool
+
+	mu      sync.Mutex
+	handles []*os.File
+}
+
+// NewFile returns a storage backed by files on disk. Files and their parent
+// directories are created on first write and grow as data arrives.
+func NewFile(files []File) (Storage, error) {
+	s := newFileStorage(files)
+
+	// Empty files never receive a write, so they are created right away.
+	for i, f := range files {
+		if f.Length > 0 {
+			continue
+		}
+
+		if _, err := s.open(i, true); err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// NewSparseFile returns a storage backed by files on disk that are created up
+// front and truncated to their final length, leaving holes that the filesystem
+// only allocates as pieces are written.
+func NewSparseFile(files []File) (Storage, error) {
+	s := newFileStorage(files)
+
+	for i, f := range files {
+		h, err := s.open(i, true)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+
+		info, err := h.Stat()
+		if err != nil {
+			s.Close()
+			return nil, fmt.Errorf("could not stat file %s: %w", f.Path, err)
+		}
+
+		if info.Size() == int64(f.Length) {
+			continue
+		}
+
+		if err := h.Truncate(int64(f.Length)); err != nil {
+			s.Close()
+			return nil, fmt.Errorf("could not resize file %s: %w", f.Path, err)
+		}
+	}
+
+	return s, nil
+}
+
+// OpenFile returns a read-only storage backed by files on disk, which are
+// never created. Missing files read as io.EOF.
+func OpenFile(files []File) Storage {
+	s := newFileStorage(files)
+	s.readOnly = true
+	return s
+}
+
+func newFileStorage(files []File) *fileStorage {
+	s := &fileStorage{
+		files:   files,
+		offsets: make([]int64, len(files)),
+		handles: make([]*os.File, len(files)),
+	}
+
+	for i, f := range files {
+		s.offsets[i] = s.length
+		s.length += int64(f.Length)
+	}
+
+	return s
+}
+
+func (s *fileStorage) ReadAt(p []byte, off int64) (int, error) {
+	return s.forEachSpan(p, off, false, func(h *os.File, b []byte, fileOff int64) (int, error) {
+		return h.ReadAt(b, fileOff)
+	})
+}
+
+func (s *fileStorage) WriteAt(p []byte, off int64) (int, error) {
+	if s.readOnly {
+		return 0, errors.New("storage is read-only")
+	}
+	if off+int64(len(p)) > s.length {
+		return 0, fmt.Errorf("write of %v bytes at offset %v exceeds storage length", len(p), off)
+	}
+
+	return s.forEachSpan(p, off, true, func(h *os.File, b []byte, fileOff int64) (int, error) {
+		return h.WriteAt(b, fileOff)
+	})
+}
+
+// forEachSpan splits the range [off, off+len(p)) at file boundaries and calls
+// fn with the handle, the slice of p and the file offset of each part.
+func (s *fileStorage) forEachSpan(p []byte, off int64, create bool, fn func(*os.File, []byte, int64) (int, error)) (int, error) {
+	if off < 0 || off > s.length {
+		return 0, fmt.Errorf("invalid storage offset: %v", off)
+	}
+
+	total := 0
+	for i, f := range s.files {
+		if total == len(p) {
+			break
+		}
+
+		start, end := s.offsets[i], s.offsets[i]+int64(f.Length)
+		if off+int64(total) >= end || f.Length == 0 {
+			continue
+		}
+
+		fileOff := off + int64(total) - start
+		n := min(int64(len(p)-total), end-start-fileOff)
+
+		h, err := s.open(i, create)
+		if err != nil {
+			return total, err
+		}
+
+		written, err := fn(h, p[total:total+int(n)], fileOff)
+		total += written
+		if err != nil {
+			return total, err
+		}
+	}
+
+	if total < len(p) {
+		return total, io.EOF
+	}
+
+	return total, nil
+}
+
+func (s *fileStorage) open(i int, create bool) (*os.File, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.handles[i] != nil {
+		return s.handles[i], nil
+	}
+
+	path := s.files[i].Path
+	flags := os.O_RDWR
+	if s.readOnly {
+		flags = os.O_RDONLY
+	} else if create {
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return nil, fmt.Errorf("could not create directory for %s: %w", path, err)
+		}
+		flags |= os.O_CREATE
+	}
+
+	h, err := os.OpenFile(path, flags, 0o644)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, io.EOF
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not open file %s: %w", path, err)
+	}
+
+	s.handles[i] = h
+	return h, nil
+}
+
+func (s *fileStorage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var errs []error
+	for i, h := range s.handles {
+		if h != nil {
+			errs = append(errs, h.Close())
+			s.handles[i] = nil
+		}
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,73 @@
+package torrent
+
+import (
+	"crypto/sha1"
+	"net"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/peer"
+)
+
+// suspectBlock records which peer sent a block of a piece that failed the
+// hash check, and the hash of what it sent.
+type suspectBlock struct {
+	begin int
+	from  *peer.Client
+	hash  [20]byte
+}
+
+// recordHashFailure deals with the peers that sent a piece failing the hash
+// check. A peer that sent the whole piece is banned right away. Otherwise the
+// blocks are remembered so that the peers that sent corrupt ones can be
+// banned once the piece is downloaded correctly, and the piece is downloaded
+// again from a single peer so that a second failure singles out the culprit.
+// It must be called with s.mu held.
+func (s *session) recordHashFailure(p *pieceProgress) {
+	contributors := map[*peer.Client]bool{}
+	for _, b := range p.blocks {
+		contributors[b.from] = true
+		s.suspects[p.index] = append(s.suspects[p.index], suspectBlock{
+			begin: b.begin,
+			from:  b.from,
+			hash:  sha1.Sum(p.data[b.begin : b.begin+b.length]),
+		})
+	}
+
+	if len(contributors) == 1 {
+		s.ban(p.blocks[0].from)
+	}
+}
+
+// recordHashSuccess bans the peers that sent blocks differing from those of a
+// piece that passed the hash check after failing it before. It must be called
+// with s.mu held.
+func (s *session) recordHashSuccess(p *pieceProgress) {
+	for _, sb := range s.suspects[p.index] {
+		b := p.block(sb.begin)
+		if sha1.Sum(p.data[b.begin:b.begin+b.length]) != sb.hash {
+			s.ban(sb.from)
+		}
+	}
+	delete(s.suspects, p.index)
+}
+
+// ban disconnects from a peer and refuses any further connection to its host
+// for the rest of the session. It must be called with s.mu held.
+func (s *session) ban(c *peer.Client) {
+	s.banned[peerHost(c.Addr())] = true
+	s.bannedClients[c] = true
+	c.Close()
+}
+
+// isBanned reports whether a peer address belongs to a banned host. It must
+// be called with s.mu held.
+func (s *session) isBanned(addr string) bool {
+	return s.banned[peerHost(addr)]
+}
+
+func peerHost(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
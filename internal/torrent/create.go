@@ -0,0 +1,234 @@
+package torrent
+
+import (
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/bencode"
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/storage"
+)
+
+const (
+	minAutoPieceLength = 16 * 1024
+	maxAutoPieceLength = 16 * 1024 * 1024
+	targetPieceCount   = 1500
+)
+
+type CreateOptions struct {
+	Announce     string
+	AnnounceList [][]string
+	Comment      string
+	CreatedBy    string
+	CreationDate time.Time
+	Private      bool
+	// PieceLength is picked from the total size of the content when zero.
+	PieceLength int
+}
+
+// Create builds the bencoded metainfo of a torrent for the file or directory
+// at path. Directories are walked recursively and their regular files are
+// added in lexical order.
+func Create(path string, opts CreateOptions) ([]byte, error) {
+	path = filepath.Clean(path)
+
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read torrent content: %w", err)
+	}
+
+	name := filepath.Base(path)
+	info := map[string]interface{}{"name": name}
+	var files []storage.File
+
+	if stat.IsDir() {
+		entries, err := collectFiles(path)
+		if err != nil {
+			return nil, err
+		}
+
+		list := make([]interface{}, len(entries))
+		for i, e := range entries {
+			components := make([]interface{}, len(e.path))
+			for j, c := range e.path {
+				components[j] = c
+			}
+			list[i] = map[string]interface{}{"length": e.length, "path": components}
+			files = append(files, storage.File{Path: filepath.Join(path, filepath.Join(e.path...)), Length: e.length})
+		}
+		info["files"] = list
+	} else {
+		if !stat.Mode().IsRegular() {
+			return nil, fmt.Errorf("unsupported torrent content: %s", path)
+		}
+
+		info["length"] = int(stat.Size())
+		files = []storage.File{{Path: path, Length: int(stat.Size())}}
+	}
+
+	totalLength := 0
+	for _, f := range files {
+		totalLength += f.Length
+	}
+
+	pieceLength := opts.PieceLength
+	if pieceLength == 0 {
+		pieceLength = pickPieceLength(totalLength)
+	}
+	if pieceLength <= 0 {
+		return nil, fmt.Errorf("invalid piece length: %v", pieceLength)
+	}
+
+	pieces, err := hashPieces(files, totalLength, pieceLength)
+	if err != nil {
+		return nil, err
+	}
+
+	info["piece length"] = pieceLength
+	info["pieces"] = pieces
+	if opts.Private {
+		info["private"] = 1
+	}
+
+	metainfo := map[string]interface{}{"info": info}
+	if opts.Announce != "" {
+		metainfo["announce"] = opts.Announce
+	}
+	if len(opts.AnnounceList) > 0 {
+		metainfo["announce-list"] = encodeTiers(opts.AnnounceList)
+	}
+	if opts.Comment != "" {
+		metainfo["comment"] = opts.Comment
+	}
+	if opts.CreatedBy != "" {
+		metainfo["created by"] = opts.CreatedBy
+	}
+	if !opts.CreationDate.IsZero() {
+		metainfo["creation date"] = int(opts.CreationDate.Unix())
+	}
+
+	return bencode.Encode(metainfo)
+}
+
+// encodeTiers returns tiers of tracker URLs in the shape of an announce list.
+func encodeTiers(tiers [][]string) []interface{} {
+	list := make([]interface{}, 0, len(tiers))
+	for _, tier := range tiers {
+		urls := make([]interface{}, len(tier))
+		for i, u := range tier {
+			urls[i] = u
+		}
+		list = append(list, urls)
+	}
+	return list
+}
+
+type contentFile struct {
+	path   []string
+	length int
+}
+
+func collectFiles(root string) ([]contentFile, error) {
+	var files []contentFile
+
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+
+		files = append(files, contentFile{path: strings.Split(filepath.ToSlash(rel), "/"), length: int(info.Size())})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not walk torrent content: %w", err)
+	}
+
+	if len(files) == 0 {
+		return nil, errors.New("torrent content directory has no files")
+	}
+
+	return files, nil
+}
+
+// pickPieceLength doubles the piece length from 16 KiB until the content fits
+// in about targetPieceCount pieces, capping it at 16 MiB.
+func pickPieceLength(totalLength int) int {
+	pieceLength := minAutoPieceLength
+	for pieceLength < maxAutoPieceLength && totalLength/pieceLength > targetPieceCount {
+		pieceLength *= 2
+	}
+	return pieceLength
+}
+
+// hashPieces computes the concatenated SHA-1 hashes of every piece of files,
+// spreading the work across one worker per CPU.
+func hashPieces(files []storage.File, totalLength, pieceLength int) (string, error) {
+	store := storage.OpenFile(files)
+	defer store.Close()
+
+	numPieces := (totalLength + pieceLength - 1) / pieceLength
+	hashes := make([]byte, numPieces*sha1.Size)
+	indexes := make(chan int)
+	stop := make(chan struct{})
+	var stopOnce sync.Once
+	var firstErr error
+	var wg sync.WaitGroup
+
+	for range runtime.NumCPU() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, pieceLength)
+			for i := range indexes {
+				length := min(pieceLength, totalLength-i*pieceLength)
+				if _, err := store.ReadAt(buf[:length], int64(i*pieceLength)); err != nil {
+					stopOnce.Do(func() {
+						firstErr = fmt.Errorf("could not read piece %v: %w", i, err)
+						close(stop)
+					})
+					return
+				}
+				hash := sha1.Sum(buf[:length])
+				copy(hashes[i*sha1.Size:], hash[:])
+			}
+		}()
+	}
+
+feed:
+	for i := range numPieces {
+		select {
+		case indexes <- i:
+		case <-stop:
+			break feed
+		}
+	}
+	close(indexes)
+	wg.Wait()
+
+	if firstErr != nil {
+		return "", firstErr
+	}
+
+	return string(hashes), nil
+}
@@ -0,0 +1,28 @@
+package torrent
+
+import (
+	"path/filepath"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/storage"
+)
+
+// FilePath returns where f is stored when the torrent is saved under output.
+func (t Torrent) FilePath(output string, f File) string {
+	return filepath.Join(append([]string{output, t.Name}, f.Path...)...)
+}
+
+// StorageFiles returns the on-disk layout of the torrent when saved to output.
+// Single-file torrents are written to output itself, while multi-file torrents
+// are written as a directory tree rooted at output/<name>.
+func (t Torrent) StorageFiles(output string) []storage.File {
+	if !t.IsMultiFile() {
+		return []storage.File{{Path: output, Length: t.Length}}
+	}
+
+	files := make([]storage.File, len(t.Files))
+	for i, f := range t.Files {
+		files[i] = storage.File{Path: t.FilePath(output, f), Length: f.Length}
+	}
+
+	return files
+}
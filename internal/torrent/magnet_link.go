@@ -1,15 +1,45 @@
 package torrent
 
 import (
+	"encoding/base32"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"math"
+	"net"
 	"net/url"
+	"slices"
+	"strconv"
 	"strings"
 )
 
+// maxSelectedFiles bounds the number of file indices a magnet link may select,
+// so that a range like 0-999999999 is not expanded.
+const maxSelectedFiles = 1 << 16
+
 type MagnetLink struct {
-	Hash       [20]byte
+	// Hash is the info hash of the torrent. For links with only a v2 info
+	// hash, it is the v2 hash truncated to 20 bytes, which v2 peers use in
+	// its place (BEP 52).
+	Hash [20]byte
+	// HashV2 is the v2 info hash of the torrent (BEP 52), or zero when the
+	// link has none.
+	HashV2     [32]byte
 	TrackerURL string
+	// Trackers holds every tracker URL of the link, the first one being
+	// TrackerURL.
+	Trackers []string
+	// Name is the display name of the torrent, or empty.
+	Name string
+	// Length is the total length of the torrent, or 0 when unknown.
+	Length int
+	// Peers holds the addresses of peers of the torrent to connect to.
+	Peers []string
+	// WebSeeds holds the URLs of web seeds of the torrent.
+	WebSeeds []string
+	// SelectedFiles holds the indices of the files to download (BEP 53), or
+	// is empty when every file is.
+	SelectedFiles []int
 }
 
 func ParseMagnetLink(rawURL string) (MagnetLink, error) {
@@ -18,17 +48,226 @@ func ParseMagnetLink(rawURL string) (MagnetLink, error) {
 		return MagnetLink{}, err
 	}
 
-	xt := u.Query().Get("xt")
-	tr := u.Query().Get("tr")
+	if u.Scheme != "magnet" {
+		return MagnetLink{}, fmt.Errorf("not a magnet link: %v", rawURL)
+	}
+
+	query := u.Query()
+	tr := query["tr"]
+
+	var ml MagnetLink
+	var hasV1, hasV2 bool
+	for _, xt := range query["xt"] {
+		switch {
+		case strings.HasPrefix(xt, "urn:btih:"):
+			if ml.Hash, err = parseBTIH(xt[len("urn:btih:"):]); err != nil {
+				return MagnetLink{}, fmt.Errorf("invalid hash format: %v", xt)
+			}
+			hasV1 = true
+
+		case strings.HasPrefix(xt, "urn:btmh:"):
+			if ml.HashV2, err = parseBTMH(xt[len("urn:btmh:"):]); err != nil {
+				return MagnetLink{}, fmt.Errorf("invalid hash format: %v: %w", xt, err)
+			}
+			hasV2 = true
+		}
+	}
+
+	if !hasV1 && !hasV2 {
+		return MagnetLink{}, fmt.Errorf("invalid hash format: %v", query.Get("xt"))
+	}
+	if !hasV1 {
+		ml.Hash = [20]byte(ml.HashV2[:20])
+	}
+
+	ml.Trackers = tr
+	if len(tr) > 0 {
+		ml.TrackerURL = tr[0]
+	}
+
+	ml.Name = query.Get("dn")
+
+	if xl := query.Get("xl"); xl != "" {
+		if ml.Length, err = strconv.Atoi(xl); err != nil || ml.Length < 0 {
+			return MagnetLink{}, fmt.Errorf("invalid exact length: %v", xl)
+		}
+	}
+
+	// Peers are only hints, so those that cannot be connected to are
+	// skipped instead of failing the whole link.
+	for _, addr := range query["x.pe"] {
+		if _, port, err := net.SplitHostPort(addr); err == nil && port != "" && port != "0" {
+			ml.Peers = append(ml.Peers, addr)
+		}
+	}
+
+	ml.WebSeeds = query["ws"]
 
-	if !strings.HasPrefix(xt, "urn:btih:") || len(xt) != 49 {
-		return MagnetLink{}, fmt.Errorf("invalid hash format: %v", xt)
+	if so := query.Get("so"); so != "" {
+		if ml.SelectedFiles, err = parseFileSelection(so); err != nil {
+			return MagnetLink{}, err
+		}
 	}
 
+	return ml, nil
+}
+
+// parseBTIH parses a v1 info hash, either hex or base32 encoded.
+func parseBTIH(s string) ([20]byte, error) {
 	var hash [20]byte
-	if _, err := hex.Decode(hash[:], []byte(xt[9:])); err != nil {
-		return MagnetLink{}, err
+
+	switch len(s) {
+	case 40:
+		_, err := hex.Decode(hash[:], []byte(s))
+		return hash, err
+
+	case 32:
+		b, err := base32.StdEncoding.DecodeString(strings.ToUpper(s))
+		if err != nil {
+			return hash, err
+		}
+		return [20]byte(b), nil
+
+	default:
+		return hash, errors.New("invalid hash length")
 	}
+}
+
+// parseBTMH parses a v2 info hash, a hex encoded SHA-256 multihash.
+func parseBTMH(s string) ([32]byte, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return [32]byte{}, err
+	}
+
+	// The multihash is prefixed by the code of SHA-256 and the digest length.
+	if len(b) != 34 || b[0] != 0x12 || b[1] != 0x20 {
+		return [32]byte{}, errors.New("unsupported multihash")
+	}
+
+	return [32]byte(b[2:]), nil
+}
+
+// parseFileSelection parses a list of file indices and inclusive ranges of
+// them, like 0,2,4-6.
+func parseFileSelection(so string) ([]int, error) {
+	var files []int
+
+	for _, item := range strings.Split(so, ",") {
+		first, last, isRange := strings.Cut(item, "-")
+
+		start, err := strconv.Atoi(first)
+		if err != nil || start < 0 {
+			return nil, fmt.Errorf("invalid file selection: %v", so)
+		}
 
-	return MagnetLink{Hash: hash, TrackerURL: tr}, nil
+		end := start
+		if isRange {
+			if end, err = strconv.Atoi(last); err != nil || end < start || end == math.MaxInt {
+				return nil, fmt.Errorf("invalid file selection: %v", so)
+			}
+		}
+
+		if end-start >= maxSelectedFiles-len(files) {
+			return nil, fmt.Errorf("too many selected files: %v", so)
+		}
+
+		for i := start; i <= end; i++ {
+			files = append(files, i)
+		}
+	}
+
+	return files, nil
+}
+
+// String returns the magnet URI of the link.
+func (ml MagnetLink) String() string {
+	var params []string
+	add := func(key, value string) {
+		params = append(params, key+"="+url.QueryEscape(value))
+	}
+
+	// Exact topics are left unescaped, as is customary.
+	if !ml.hasOnlyV2Hash() {
+		params = append(params, "xt=urn:btih:"+hex.EncodeToString(ml.Hash[:]))
+	}
+	if ml.HashV2 != [32]byte{} {
+		params = append(params, "xt=urn:btmh:1220"+hex.EncodeToString(ml.HashV2[:]))
+	}
+	if ml.Name != "" {
+		add("dn", ml.Name)
+	}
+	if ml.Length > 0 {
+		add("xl", strconv.Itoa(ml.Length))
+	}
+	for _, u := range ml.Trackers {
+		add("tr", u)
+	}
+	for _, u := range ml.WebSeeds {
+		add("ws", u)
+	}
+	for _, addr := range ml.Peers {
+		add("x.pe", addr)
+	}
+	if len(ml.SelectedFiles) > 0 {
+		add("so", formatFileSelection(ml.SelectedFiles))
+	}
+
+	return "magnet:?" + strings.Join(params, "&")
+}
+
+// hasOnlyV2Hash reports whether Hash is the truncated v2 info hash.
+func (ml MagnetLink) hasOnlyV2Hash() bool {
+	return ml.HashV2 != [32]byte{} && [20]byte(ml.HashV2[:20]) == ml.Hash
+}
+
+// formatFileSelection formats file indices the way parseFileSelection parses
+// them, with runs of consecutive indices as ranges.
+func formatFileSelection(files []int) string {
+	var items []string
+
+	for i := 0; i < len(files); {
+		j := i
+		for j+1 < len(files) && files[j+1] == files[j]+1 {
+			j++
+		}
+
+		if j > i {
+			items = append(items, fmt.Sprintf("%d-%d", files[i], files[j]))
+		} else {
+			items = append(items, strconv.Itoa(files[i]))
+		}
+		i = j + 1
+	}
+
+	return strings.Join(items, ",")
+}
+
+// MagnetLink returns the magnet link of the torrent.
+func (t Torrent) MagnetLink() MagnetLink {
+	ml := MagnetLink{Hash: t.Hash, Name: t.Name, Length: t.Length}
+	if t.TrackerURL != "" {
+		ml.Trackers = []string{t.TrackerURL}
+	}
+	for _, tier := range t.Trackers {
+		for _, u := range tier {
+			if !slices.Contains(ml.Trackers, u) {
+				ml.Trackers = append(ml.Trackers, u)
+			}
+		}
+	}
+	if len(ml.Trackers) > 0 {
+		ml.TrackerURL = ml.Trackers[0]
+	}
+	return ml
+}
+
+// TrackerTiers returns the trackers of the link as an announce list, each
+// tracker in its own tier.
+func (ml MagnetLink) TrackerTiers() [][]string {
+	tiers := make([][]string, len(ml.Trackers))
+	for i, u := range ml.Trackers {
+		tiers[i] = []string{u}
+	}
+	return tiers
 }
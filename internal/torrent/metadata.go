@@ -0,0 +1,185 @@
+package torrent
+
+import (
+	"cmp"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/bencode"
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/peer"
+)
+
+var errMetadataHash = errors.New("metadata does not match the info hash")
+
+// FetchMetadata fetches the info dictionary of the torrent of the link from
+// clients, which must have done the handshake with the metadata extension, and
+// returns the complete torrent. The pieces of the dictionary are requested
+// from every client at once, and the dictionary is checked against the info
+// hash of the link.
+func (ml MagnetLink) FetchMetadata(clients peer.Clients) (Torrent, error) {
+	var errs []error
+
+	// Peers disagreeing on the size of the dictionary cannot all be right,
+	// so the size most of them advertise is tried first.
+	for _, size := range metadataSizes(clients) {
+		candidates := slices.DeleteFunc(slices.Clone(clients), func(c *peer.Client) bool {
+			return c.ExtensionHandshake().MetadataSize != size
+		})
+
+		t, err := ml.fetchMetadata(candidates, size)
+		if err == nil {
+			return t, nil
+		}
+		errs = append(errs, err)
+
+		// When the pieces sent by several peers do not add up to the right
+		// dictionary, some of them sent bad data, so each is asked for the
+		// whole dictionary alone.
+		if !errors.Is(err, errMetadataHash) || len(candidates) == 1 {
+			continue
+		}
+
+		for _, c := range candidates {
+			t, err := ml.fetchMetadata(peer.Clients{c}, size)
+			if err == nil {
+				return t, nil
+			}
+			errs = append(errs, err)
+		}
+	}
+
+	if len(errs) == 0 {
+		return Torrent{}, errors.New("no peer advertised the size of the torrent metadata")
+	}
+
+	return Torrent{}, fmt.Errorf("could not fetch the torrent metadata: %w", errors.Join(errs...))
+}
+
+// metadataSizes returns the sizes of the info dictionary advertised by
+// clients, the most advertised first.
+func metadataSizes(clients peer.Clients) []int {
+	counts := map[int]int{}
+	var sizes []int
+
+	for _, c := range clients {
+		size := c.ExtensionHandshake().MetadataSize
+		if size <= 0 || size > peer.MaxMetadataSize {
+			continue
+		}
+		if counts[size] == 0 {
+			sizes = append(sizes, size)
+		}
+		counts[size]++
+	}
+
+	slices.SortStableFunc(sizes, func(a, b int) int { return cmp.Compare(counts[b], counts[a]) })
+
+	return sizes
+}
+
+// fetchMetadata fetches an info dictionary of size bytes, spreading the
+// requests for its pieces over clients. A client that fails or rejects a
+// request is not asked for more pieces, and the piece is requested from the
+// others instead.
+func (ml MagnetLink) fetchMetadata(clients peer.Clients, size int) (Torrent, error) {
+	numPieces := (size + peer.MetadataPieceSize - 1) / peer.MetadataPieceSize
+	metadata := make([]byte, size)
+
+	var mu sync.Mutex
+	cond := sync.NewCond(&mu)
+	queue := make([]int, numPieces)
+	for i := range queue {
+		queue[i] = i
+	}
+	inFlight := 0
+	received := 0
+
+	errs := make([]error, len(clients))
+	var wg sync.WaitGroup
+
+	for i, c := range clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			for {
+				// Pieces in flight at other peers may come back to the queue.
+				for len(queue) == 0 && inFlight > 0 {
+					cond.Wait()
+				}
+				if len(queue) == 0 {
+					return
+				}
+
+				piece := queue[0]
+				queue = queue[1:]
+				inFlight++
+				mu.Unlock()
+
+				data, err := c.RequestMetadataPiece(piece)
+				begin := piece * peer.MetadataPieceSize
+				if length := min(peer.MetadataPieceSize, size-begin); err == nil && len(data) != length {
+					err = fmt.Errorf("metadata piece %v has %v bytes instead of %v", piece, len(data), length)
+				}
+
+				mu.Lock()
+				inFlight--
+				cond.Broadcast()
+
+				if err != nil {
+					queue = append(queue, piece)
+					errs[i] = fmt.Errorf("peer %s: %w", c.Addr(), err)
+					return
+				}
+
+				copy(metadata[begin:], data)
+				received++
+			}
+		}()
+	}
+	wg.Wait()
+
+	if received < numPieces {
+		return Torrent{}, fmt.Errorf("no peer left to fetch the metadata from: %w", errors.Join(errs...))
+	}
+
+	return ml.parseMetadata(metadata)
+}
+
+// parseMetadata returns the torrent of the link described by an info
+// dictionary fetched from peers.
+func (ml MagnetLink) parseMetadata(metadata []byte) (Torrent, error) {
+	if sha1.Sum(metadata) != ml.Hash {
+		return Torrent{}, errMetadataHash
+	}
+
+	obj, err := bencode.Decode(metadata)
+	if err != nil {
+		return Torrent{}, fmt.Errorf("could not decode torrent metadata: %w", err)
+	}
+
+	info, ok := obj.(map[string]interface{})
+	if !ok {
+		return Torrent{}, errors.New("torrent metadata is not a dictionary")
+	}
+
+	t, err := parseInfo(info)
+	if err != nil {
+		return Torrent{}, err
+	}
+
+	// The dictionary is kept as fetched, as re-encoding it may not give
+	// back the bytes the info hash is the hash of.
+	t.Hash = ml.Hash
+	t.Info = metadata
+	t.TrackerURL = ml.TrackerURL
+	t.Trackers = ml.TrackerTiers()
+
+	return t, nil
+}
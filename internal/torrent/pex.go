@@ -0,0 +1,138 @@
+package torrent
+
+import (
+	"context"
+	"slices"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/peer"
+)
+
+const (
+	// pexInterval is how often each peer is told about the peers we connected
+	// to and disconnected from. BEP 11 allows one message a minute.
+	pexInterval = time.Minute
+	// pexConnectInterval spaces out the connections to the peers learned
+	// through peer exchange, so that a burst of them does not flood us.
+	pexConnectInterval = 250 * time.Millisecond
+	// maxPEXQueue bounds the number of peers learned through peer exchange
+	// waiting to be connected to.
+	maxPEXQueue = 200
+	// maxPEXPeers is the number of connected peers past which the peers
+	// learned through peer exchange are no longer connected to.
+	maxPEXPeers = 50
+)
+
+// Handshake performs the handshake with every client and returns those that
+// succeeded, advertising the extensions of the torrent and port as the port we
+// accept connections on, unless 0.
+func (t Torrent) Handshake(clients peer.Clients, port int) (peer.Clients, error) {
+	return clients.HandshakeWithExtensions(t.Hash, t.extensions(port))
+}
+
+// extensions returns the extensions advertised to the peers of the torrent:
+// ut_metadata, serving its info dictionary, and peer exchange unless the
+// torrent is private, as private torrents only get peers from their trackers.
+func (t Torrent) extensions(port int) *peer.Extensions {
+	e := peer.NewExtensions()
+	e.Port = port
+	e.Register(peer.MetadataExtension, peer.ServeMetadata(t.Info))
+	e.MetadataSize = len(t.Info)
+	if !t.Private {
+		e.Register(peer.PEXExtension, peer.PEXHandler)
+	}
+	return e
+}
+
+// queuePEXPeers queues peers learned through peer exchange to be connected to,
+// unless they are banned or already connected.
+func (s *session) queuePEXPeers(peers []peer.PEXPeer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, p := range peers {
+		if len(s.pexQueue) >= maxPEXQueue {
+			return
+		}
+		if !s.isKnown(p.Addr) && !slices.Contains(s.pexQueue, p.Addr) {
+			s.pexQueue = append(s.pexQueue, p.Addr)
+		}
+	}
+}
+
+// connectPEXPeers connects to the queued peers one at a time, while fewer than
+// maxPEXPeers are connected, until the download completes or fails.
+func (s *session) connectPEXPeers(ctx context.Context) {
+	ticker := time.NewTicker(pexConnectInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-s.done:
+			return
+
+		case <-ticker.C:
+			s.mu.Lock()
+			var addr string
+			if len(s.pexQueue) > 0 && len(s.clients)+len(s.connecting) < maxPEXPeers {
+				addr = s.pexQueue[0]
+				s.pexQueue = s.pexQueue[1:]
+			}
+			s.mu.Unlock()
+
+			if addr != "" {
+				s.connect(ctx, addr)
+			}
+		}
+	}
+}
+
+// sendPEX tells c about the peers connected since the previous message and
+// those that went away. sent holds the peers c was told about so far.
+func (s *session) sendPEX(c *peer.Client, sent map[string]bool) error {
+	if !c.SupportsPEX() {
+		return nil
+	}
+
+	// Every peer of the session was connected to, so they all accept
+	// connections.
+	current := map[string]byte{}
+	s.mu.Lock()
+	for _, o := range s.clients {
+		if o == c {
+			continue
+		}
+
+		flags := peer.PEXReachable
+		if o.PieceCount() == len(s.t.PieceHashes) {
+			flags |= peer.PEXSeed
+		}
+		current[o.Addr()] = flags
+	}
+	s.mu.Unlock()
+
+	var added []peer.PEXPeer
+	for addr, flags := range current {
+		if !sent[addr] && len(added) < peer.MaxPEXPeers {
+			added = append(added, peer.PEXPeer{Addr: addr, Flags: flags})
+			sent[addr] = true
+		}
+	}
+
+	var dropped []string
+	for addr := range sent {
+		if _, ok := current[addr]; !ok && len(dropped) < peer.MaxPEXPeers {
+			dropped = append(dropped, addr)
+			delete(sent, addr)
+		}
+	}
+
+	if len(added) == 0 && len(dropped) == 0 {
+		return nil
+	}
+
+	return c.SendPEX(added, dropped)
+}
@@ -0,0 +1,66 @@
+package torrent
+
+import (
+	"math/rand/v2"
+	"slices"
+)
+
+// randomFirstPieces is how many pieces the rarest-first picker picks at random
+// before switching to rarest first. Random pieces are usually well replicated,
+// so they complete quickly and give us something to upload early on.
+const randomFirstPieces = 4
+
+// PickInput describes the choice a PiecePicker has to make.
+type PickInput struct {
+	// Candidates are the missing pieces that can be downloaded. It is never
+	// empty.
+	Candidates []int
+	// Availability is the number of connected peers that have each piece.
+	Availability []int
+	// Completed is the number of pieces already verified.
+	Completed int
+}
+
+// PiecePicker decides the order in which pieces are downloaded.
+type PiecePicker interface {
+	Pick(input PickInput) int
+}
+
+type rarestFirstPicker struct{}
+
+// NewRarestFirstPicker returns a picker that downloads the pieces held by the
+// fewest peers first, breaking ties at random, after picking the first few
+// pieces at random.
+func NewRarestFirstPicker() PiecePicker {
+	return rarestFirstPicker{}
+}
+
+func (rarestFirstPicker) Pick(input PickInput) int {
+	if input.Completed < randomFirstPieces {
+		return input.Candidates[rand.IntN(len(input.Candidates))]
+	}
+
+	var rarest []int
+	for _, i := range input.Candidates {
+		switch {
+		case len(rarest) == 0 || input.Availability[i] < input.Availability[rarest[0]]:
+			rarest = append(rarest[:0], i)
+		case input.Availability[i] == input.Availability[rarest[0]]:
+			rarest = append(rarest, i)
+		}
+	}
+
+	return rarest[rand.IntN(len(rarest))]
+}
+
+type sequentialPicker struct{}
+
+// NewSequentialPicker returns a picker that downloads pieces in index order,
+// which allows consuming the data while it is being downloaded.
+func NewSequentialPicker() PiecePicker {
+	return sequentialPicker{}
+}
+
+func (sequentialPicker) Pick(input PickInput) int {
+	return slices.Min(input.Candidates)
+}
@@ -0,0 +1,138 @@
+package torrent
+
+import (
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/peer"
+)
+
+const (
+	blockMaxSize = 16 * 1024
+	// maxRequestsInFlight is how many block requests are pipelined to a peer.
+	maxRequestsInFlight = 5
+)
+
+type blockProgress struct {
+	begin       int
+	length      int
+	received    bool
+	requestedBy []*peer.Client
+	// from is the peer the block was received from.
+	from *peer.Client
+}
+
+// pieceProgress tracks the blocks of a piece being downloaded from several
+// peers at once. It is not safe for concurrent use.
+type pieceProgress struct {
+	index   int
+	data    []byte
+	blocks  []blockProgress
+	missing int
+	// exclusive is the only peer blocks may be requested from, when the
+	// piece is downloaded again after failing the hash check.
+	exclusive *peer.Client
+}
+
+func newPieceProgress(index, length int) *pieceProgress {
+	p := &pieceProgress{index: index, data: make([]byte, length)}
+
+	for begin := 0; begin < length; begin += blockMaxSize {
+		p.blocks = append(p.blocks, blockProgress{begin: begin, length: min(blockMaxSize, length-begin)})
+	}
+	p.missing = len(p.blocks)
+
+	return p
+}
+
+// nextRequest returns a block for c to request among the blocks nobody
+// requested yet or, when duplicate is set, among the blocks requested from
+// other peers only.
+func (p *pieceProgress) nextRequest(c *peer.Client, duplicate bool) (peer.RequestPieceInput, bool) {
+	for i := range p.blocks {
+		b := &p.blocks[i]
+		if b.received || (!duplicate && len(b.requestedBy) > 0) || containsClient(b.requestedBy, c) {
+			continue
+		}
+
+		b.requestedBy = append(b.requestedBy, c)
+		return peer.RequestPieceInput{Index: p.index, Begin: b.begin, Length: b.length}, true
+	}
+
+	return peer.RequestPieceInput{}, false
+}
+
+// canRequestFrom reports whether blocks of the piece may be requested from c.
+func (p *pieceProgress) canRequestFrom(c *peer.Client) bool {
+	return c.HasPiece(p.index) && (p.exclusive == nil || p.exclusive == c)
+}
+
+// hasUnrequestedBlocks reports whether some block was not requested from any
+// peer yet.
+func (p *pieceProgress) hasUnrequestedBlocks() bool {
+	for _, b := range p.blocks {
+		if !b.received && len(b.requestedBy) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// receive stores a block sent by c. It returns the other peers the block was
+// requested from, whose requests should be cancelled, and false if the block
+// was not expected.
+func (p *pieceProgress) receive(c *peer.Client, begin int, data []byte) ([]*peer.Client, bool) {
+	b := p.block(begin)
+	if b == nil || b.received || b.length != len(data) {
+		return nil, false
+	}
+
+	copy(p.data[begin:], data)
+	b.received = true
+	b.from = c
+	p.missing--
+
+	var others []*peer.Client
+	for _, o := range b.requestedBy {
+		if o != c {
+			others = append(others, o)
+		}
+	}
+	b.requestedBy = nil
+
+	return others, true
+}
+
+// release forgets that a block was requested from c, so that it can be
+// requested again.
+func (p *pieceProgress) release(c *peer.Client, begin int) {
+	b := p.block(begin)
+	if b == nil || b.received {
+		return
+	}
+
+	for i, o := range b.requestedBy {
+		if o == c {
+			b.requestedBy = append(b.requestedBy[:i], b.requestedBy[i+1:]...)
+			break
+		}
+	}
+}
+
+func (p *pieceProgress) isReceived(begin int) bool {
+	b := p.block(begin)
+	return b == nil || b.received
+}
+
+func (p *pieceProgress) block(begin int) *blockProgress {
+	if begin%blockMaxSize != 0 || begin/blockMaxSize >= len(p.blocks) {
+		return nil
+	}
+	return &p.blocks[begin/blockMaxSize]
+}
+
+func containsClient(clients []*peer.Client, c *peer.Client) bool {
+	for _, o := range clients {
+		if o == c {
+			return true
+		}
+	}
+	return false
+}
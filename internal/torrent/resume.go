@@ -0,0 +1,153 @@
+package torrent
+
+import (
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/atomicfile"
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/bencode"
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/bitfield"
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/storage"
+)
+
+// ResumeFilePath returns where the piece completion state of a download saved
+// to output is kept.
+func ResumeFilePath(output string) string {
+	return filepath.Clean(output) + ".resume"
+}
+
+// PieceBounds returns the offset and length of a piece in the piece space.
+func (t Torrent) PieceBounds(index int) (int, int) {
+	offset := index * t.PieceLength
+	return offset, min(t.PieceLength, t.Length-offset)
+}
+
+// MissingLength returns the total length of the pieces not set in completed.
+func (t Torrent) MissingLength(completed bitfield.Bitfield) int {
+	missing := 0
+	for i := range t.PieceHashes {
+		if !completed.Has(i) {
+			_, length := t.PieceBounds(i)
+			missing += length
+		}
+	}
+	return missing
+}
+
+// VerifyPiece reports whether the data stored for a piece matches its hash.
+// Data that is missing from store is reported as not matching.
+func (t Torrent) VerifyPiece(store storage.Storage, index int) (bool, error) {
+	offset, length := t.PieceBounds(index)
+	data := make([]byte, length)
+
+	if _, err := store.ReadAt(data, int64(offset)); err != nil {
+		if errors.Is(err, io.EOF) {
+			return false, nil
+		}
+		return false, fmt.Errorf("could not read piece %v: %w", index, err)
+	}
+
+	hash := sha1.Sum(data)
+	return hash == t.PieceHashes[index], nil
+}
+
+// VerifyPieces returns the pieces whose data in store matches their hash.
+func (t Torrent) VerifyPieces(store storage.Storage) (bitfield.Bitfield, error) {
+	completed := bitfield.New(len(t.PieceHashes))
+	for i := range t.PieceHashes {
+		ok, err := t.VerifyPiece(store, i)
+		if err != nil {
+			return nil, err
+		}
+
+		if ok {
+			completed.Set(i)
+		}
+	}
+
+	return completed, nil
+}
+
+// LoadCompletedPieces returns the pieces of store that are already verified.
+// Only the pieces recorded in the resume file are rechecked, everything else is
+// considered missing.
+func (t Torrent) LoadCompletedPieces(store storage.Storage, resumeFile string) (bitfield.Bitfield, error) {
+	completed := bitfield.New(len(t.PieceHashes))
+
+	candidates, err := t.readResumeFile(resumeFile)
+	if err != nil || candidates == nil {
+		return completed, err
+	}
+
+	for i := range t.PieceHashes {
+		if !candidates.Has(i) {
+			continue
+		}
+
+		ok, err := t.VerifyPiece(store, i)
+		if err != nil {
+			return nil, err
+		}
+
+		if ok {
+			completed.Set(i)
+		}
+	}
+
+	return completed, nil
+}
+
+func (t Torrent) readResumeFile(resumeFile string) (bitfield.Bitfield, error) {
+	if resumeFile == "" {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(resumeFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read resume file: %w", err)
+	}
+
+	obj, err := bencode.Decode(data)
+	if err != nil {
+		return nil, nil
+	}
+
+	dict, _ := obj.(map[string]interface{})
+	hash, _ := dict["info hash"].(string)
+	pieces, _ := dict["pieces"].(string)
+
+	// A resume file left by another torrent or in an unexpected shape is
+	// ignored and the download starts from scratch.
+	if hash != string(t.Hash[:]) || len(pieces) != len(bitfield.New(len(t.PieceHashes))) {
+		return nil, nil
+	}
+
+	return bitfield.Bitfield(pieces), nil
+}
+
+func (t Torrent) writeResumeFile(resumeFile string, completed bitfield.Bitfield) error {
+	if resumeFile == "" {
+		return nil
+	}
+
+	data, err := bencode.Encode(map[string]interface{}{
+		"info hash": string(t.Hash[:]),
+		"pieces":    string(completed),
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := atomicfile.WriteFile(resumeFile, data, 0o644); err != nil {
+		return fmt.Errorf("could not write resume file: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,115 @@
+package torrent
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/bitfield"
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/peer"
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/storage"
+)
+
+// Seeder serves the verified pieces of a torrent to other peers.
+type Seeder struct {
+	t     Torrent
+	store storage.Storage
+	stats *Stats
+
+	mu        sync.Mutex
+	completed bitfield.Bitfield
+	// clients are the peers served, which are told about new pieces.
+	clients map[*peer.Client]struct{}
+}
+
+// NewSeeder returns a seeder of the completed pieces of a torrent, counting
+// the uploaded data in stats unless it is nil.
+func NewSeeder(t Torrent, store storage.Storage, completed bitfield.Bitfield, stats *Stats) *Seeder {
+	return &Seeder{
+		t:         t,
+		store:     store,
+		stats:     stats,
+		completed: slices.Clone(completed),
+		clients:   map[*peer.Client]struct{}{},
+	}
+}
+
+// Seed uploads the torrent to the peers connecting through l.
+func (s *Seeder) Seed(l *peer.Listener) {
+	l.HandleWithExtensions(s.t.Hash, s.t.extensions(l.Port()), func(c *peer.Client) {
+		c.SetPieceCount(len(s.t.PieceHashes))
+
+		// The client is only told about new pieces once it has the bitfield,
+		// which must come first.
+		s.mu.Lock()
+		err := c.SendBitfield(s.completed)
+		if err == nil {
+			s.clients[c] = struct{}{}
+		}
+		s.mu.Unlock()
+		if err != nil {
+			return
+		}
+
+		defer func() {
+			s.mu.Lock()
+			delete(s.clients, c)
+			s.mu.Unlock()
+		}()
+
+		c.Serve(s)
+	})
+}
+
+// addPiece makes a piece stored since the seeder was created available, and
+// tells the peers served about it. A nil *Seeder does nothing.
+func (s *Seeder) addPiece(index int) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	s.completed.Set(index)
+	clients := make([]*peer.Client, 0, len(s.clients))
+	for c := range s.clients {
+		clients = append(clients, c)
+	}
+	s.mu.Unlock()
+
+	// A peer that cannot be written to is dropped by its own handler.
+	for _, c := range clients {
+		c.SendHave(index)
+	}
+}
+
+// Bitfield returns the pieces available.
+func (s *Seeder) Bitfield() bitfield.Bitfield {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.completed)
+}
+
+func (s *Seeder) HasPiece(index int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.completed.Has(index)
+}
+
+func (s *Seeder) ReadBlock(index, begin int, data []byte) error {
+	if !s.HasPiece(index) {
+		return fmt.Errorf("piece %v is not available", index)
+	}
+
+	_, pieceLength := s.t.PieceBounds(index)
+	if begin < 0 || begin+len(data) > pieceLength {
+		return fmt.Errorf("invalid block range for piece %v: %v+%v", index, begin, len(data))
+	}
+
+	if _, err := s.store.ReadAt(data, int64(index*s.t.PieceLength+begin)); err != nil {
+		return fmt.Errorf("could not read piece %v: %w", index, err)
+	}
+
+	s.stats.addUploaded(len(data))
+
+	return nil
+}
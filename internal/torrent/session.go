@@ -0,0 +1,577 @@
+package torrent
+
+import (
+	"context"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/bitfield"
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/peer"
+)
+
+type blockKey struct {
+	index int
+	begin int
+}
+
+// session downloads a set of pieces from several peers at once. Every peer
+// continuously requests blocks of any wanted piece it has, and each piece is
+// verified independently as soon as all its blocks arrived.
+type session struct {
+	t        Torrent
+	clients  peer.Clients
+	picker   PiecePicker
+	stats    *Stats
+	newPeers <-chan []string
+	// port is the port we accept connections on, or 0.
+	port int
+	// pex is set when peers are exchanged with the other peers, which
+	// private torrents forbid.
+	pex bool
+	// onPiece is called with the data of every verified piece. Calls are
+	// serialized.
+	onPiece func(index int, data []byte) error
+
+	mu        sync.Mutex
+	wanted    bitfield.Bitfield
+	remaining int
+	left      int
+	completed int
+	// connecting holds the addresses of the discovered peers being connected
+	// to.
+	connecting map[string]bool
+	// pexQueue holds the addresses of the peers learned through peer exchange
+	// waiting to be connected to.
+	pexQueue  []string
+	active    map[int]*pieceProgress
+	verifying map[int]bool
+	// released is closed and replaced whenever blocks become requestable
+	// again, to wake up the workers that had nothing left to request.
+	released chan struct{}
+	done     chan struct{}
+
+	// suspects holds the blocks of the pieces that failed the hash check,
+	// until the piece is downloaded correctly.
+	suspects      map[int][]suspectBlock
+	banned        map[string]bool
+	bannedClients map[*peer.Client]bool
+
+	pieceMu  sync.Mutex
+	verifyWg sync.WaitGroup
+	workers  sync.WaitGroup
+	cancel   context.CancelCauseFunc
+}
+
+func (t Torrent) newSession(clients peer.Clients, wanted bitfield.Bitfield, opts DownloadOptions, onPiece func(int, []byte) error) *session {
+	picker := opts.Picker
+	if picker == nil {
+		picker = NewRarestFirstPicker()
+	}
+
+	left := 0
+	for i := range t.PieceHashes {
+		if wanted.Has(i) {
+			_, length := t.PieceBounds(i)
+			left += length
+		}
+	}
+
+	s := &session{
+		t:          t,
+		clients:    clients,
+		picker:     picker,
+		stats:      opts.Stats,
+		newPeers:   opts.Peers,
+		port:       opts.Port,
+		pex:        !t.Private,
+		onPiece:    onPiece,
+		wanted:     wanted,
+		remaining:  wanted.Count(),
+		left:       left,
+		completed:  len(t.PieceHashes) - wanted.Count(),
+		connecting: map[string]bool{},
+		active:     map[int]*pieceProgress{},
+		verifying:  map[int]bool{},
+		released:   make(chan struct{}),
+		done:       make(chan struct{}),
+
+		suspects:      map[int][]suspectBlock{},
+		banned:        map[string]bool{},
+		bannedClients: map[*peer.Client]bool{},
+	}
+
+	for _, c := range clients {
+		c.SetPieceCount(len(t.PieceHashes))
+	}
+
+	if s.remaining == 0 {
+		close(s.done)
+	}
+
+	s.stats.setLeft(left)
+
+	return s
+}
+
+// run downloads the wanted pieces and returns once they are all verified or
+// no progress is possible anymore.
+func (s *session) run() error {
+	if s.remaining == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+	s.cancel = cancel
+
+	for _, c := range s.clients {
+		s.workers.Add(1)
+		go func(c *peer.Client) {
+			defer s.workers.Done()
+			if err := s.worker(ctx, c); err != nil {
+				s.dropPeer(c, err)
+			}
+		}(c)
+	}
+
+	if s.newPeers != nil {
+		s.workers.Add(1)
+		go func() {
+			defer s.workers.Done()
+			s.acceptPeers(ctx)
+		}()
+	}
+
+	if s.pex {
+		s.workers.Add(1)
+		go func() {
+			defer s.workers.Done()
+			s.connectPEXPeers(ctx)
+		}()
+	}
+
+	s.workers.Wait()
+	s.verifyWg.Wait()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.remaining == 0 {
+		return nil
+	}
+
+	if err := context.Cause(ctx); err != nil {
+		return err
+	}
+
+	return errors.New("download stopped before completion")
+}
+
+// dropPeer disconnects from a peer that failed. The download carries on with
+// the other peers and only fails once none is left.
+func (s *session) dropPeer(c *peer.Client, err error) {
+	c.Close()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.clients = slices.DeleteFunc(slices.Clone(s.clients), func(o *peer.Client) bool { return o == c })
+
+	// Pieces reserved for the peer become available to the others.
+	for _, p := range s.active {
+		if p.exclusive == c {
+			p.exclusive = nil
+		}
+	}
+	s.notifyReleased()
+
+	if s.bannedClients[c] {
+		err = fmt.Errorf("peer %s banned for sending corrupt data", c.Addr())
+	}
+
+	s.checkPeersLeft(err)
+}
+
+// checkPeersLeft fails the download when no peer is left to download from,
+// err being the reason the last one went away. It must be called with s.mu
+// held.
+func (s *session) checkPeersLeft(err error) {
+	if len(s.clients) == 0 && len(s.connecting) == 0 && len(s.pexQueue) == 0 && s.remaining > 0 {
+		s.cancel(fmt.Errorf("no peer left to download from: %w", err))
+	}
+}
+
+// isKnown reports whether the peer at addr is banned, being connected to or
+// connected. It must be called with s.mu held.
+func (s *session) isKnown(addr string) bool {
+	return s.isBanned(addr) || s.connecting[addr] || slices.ContainsFunc(s.clients, func(c *peer.Client) bool { return c.Addr() == addr })
+}
+
+// acceptPeers connects to the peers discovered during the download until it
+// completes or fails.
+func (s *session) acceptPeers(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-s.done:
+			return
+
+		case addrs := <-s.newPeers:
+			for _, addr := range addrs {
+				s.connect(ctx, addr)
+			}
+		}
+	}
+}
+
+// connect adds the peer at addr to the download, unless it is already
+// connected or banned.
+func (s *session) connect(ctx context.Context, addr string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.isKnown(addr) {
+		// The address may have been the last hope of the download.
+		s.checkPeersLeft(fmt.Errorf("peer %s is banned or already connected", addr))
+		return
+	}
+	s.connecting[addr] = true
+
+	s.workers.Add(1)
+	go func() {
+		defer s.workers.Done()
+
+		c, err := s.dial(addr)
+
+		s.mu.Lock()
+		delete(s.connecting, addr)
+		if err != nil {
+			s.checkPeersLeft(err)
+			s.mu.Unlock()
+			return
+		}
+		s.clients = append(slices.Clone(s.clients), c)
+		s.mu.Unlock()
+
+		defer c.Close()
+		if err := s.worker(ctx, c); err != nil {
+			s.dropPeer(c, err)
+		}
+	}()
+}
+
+func (s *session) dial(addr string) (*peer.Client, error) {
+	c, err := peer.NewClient(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.HandshakeWithExtensions(s.t.Hash, s.t.extensions(s.port)); err != nil {
+		c.Close()
+		return nil, err
+	}
+	c.SetPieceCount(len(s.t.PieceHashes))
+
+	if err := c.SetInterested(true); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// checkProgress fails the download when none of the remaining peers has any
+// of the missing pieces and no piece is in progress, since nothing can
+// complete it anymore.
+func (s *session) checkProgress() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.remaining == 0 || len(s.active) > 0 || len(s.verifying) > 0 || len(s.connecting) > 0 || len(s.pexQueue) > 0 {
+		return
+	}
+
+	for _, c := range s.clients {
+		// A peer connected to during the download may not have sent its
+		// bitfield yet, and is waited for.
+		if !c.HasAnnouncedPieces() {
+			return
+		}
+		for i := range s.t.PieceHashes {
+			if s.wanted.Has(i) && c.HasPiece(i) {
+				return
+			}
+		}
+	}
+
+	s.cancel(fmt.Errorf("no peer has any of the %v missing pieces", s.remaining))
+}
+
+// worker requests blocks from a single peer until every wanted piece is
+// verified. Requests are only sent while the peer unchokes us, and those it
+// drops by choking us are released so that any peer can request them again.
+//
+// When the worker fails, the blocks requested from its peer are released for
+// the other peers to request.
+func (s *session) worker(ctx context.Context, c *peer.Client) error {
+	inFlight := map[blockKey]peer.RequestPieceInput{}
+	defer func() { s.release(c, inFlight) }()
+
+	var pexTick <-chan time.Time
+	if s.pex {
+		ticker := time.NewTicker(pexInterval)
+		defer ticker.Stop()
+		pexTick = ticker.C
+	}
+	pexSent := map[string]bool{}
+
+	for {
+		s.pruneInFlight(inFlight)
+
+		if !c.State().PeerChoking && len(inFlight) < maxRequestsInFlight {
+			if input, ok := s.nextRequest(c); ok {
+				inFlight[blockKey{input.Index, input.Begin}] = input
+				if err := c.RequestPiece(input); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+
+		if len(inFlight) == 0 {
+			s.checkProgress()
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+
+		case <-s.done:
+			return nil
+
+		case <-s.releasedChan():
+
+		case <-pexTick:
+			if err := s.sendPEX(c, pexSent); err != nil {
+				return err
+			}
+
+		case ev, ok := <-c.Events():
+			if !ok {
+				return fmt.Errorf("peer connection closed: %w", c.Err())
+			}
+
+			switch ev.Type {
+			case peer.PieceEvent:
+				key := blockKey{ev.Index, ev.Begin}
+				if _, found := inFlight[key]; !found {
+					continue
+				}
+				delete(inFlight, key)
+
+				for _, o := range s.receive(c, ev.Index, ev.Begin, ev.Data) {
+					// The block may still arrive from the other peers, which
+					// is harmless, so failing to cancel is not an error.
+					o.CancelPiece(peer.RequestPieceInput{Index: ev.Index, Begin: ev.Begin, Length: len(ev.Data)})
+				}
+
+			case peer.ChokeEvent:
+				s.release(c, inFlight)
+				clear(inFlight)
+
+			case peer.PEXEvent:
+				if s.pex {
+					s.queuePEXPeers(ev.Peers)
+				}
+			}
+		}
+	}
+}
+
+// nextRequest returns a block for c to request. Blocks of the pieces already
+// being downloaded come first, then a new piece is picked. Once every missing
+// block has been requested, the session enters endgame mode and blocks
+// pending at other peers are requested from c too. Pieces that failed the
+// hash check before are downloaded from a single peer.
+func (s *session) nextRequest(c *peer.Client) (peer.RequestPieceInput, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, p := range s.active {
+		if !p.canRequestFrom(c) {
+			continue
+		}
+		if input, ok := p.nextRequest(c, false); ok {
+			return input, true
+		}
+	}
+
+	var candidates []int
+	for i := range s.t.PieceHashes {
+		if s.wanted.Has(i) && s.active[i] == nil && !s.verifying[i] && c.HasPiece(i) {
+			candidates = append(candidates, i)
+		}
+	}
+
+	if len(candidates) > 0 {
+		i := s.picker.Pick(PickInput{
+			Candidates:   candidates,
+			Availability: s.clients.Availability(len(s.t.PieceHashes)),
+			Completed:    s.completed,
+		})
+
+		_, length := s.t.PieceBounds(i)
+		p := newPieceProgress(i, length)
+		if len(s.suspects[i]) > 0 {
+			p.exclusive = c
+		}
+		s.active[i] = p
+		return p.nextRequest(c, false)
+	}
+
+	if !s.isEndgame() {
+		return peer.RequestPieceInput{}, false
+	}
+
+	for _, p := range s.active {
+		if !p.canRequestFrom(c) {
+			continue
+		}
+		if input, ok := p.nextRequest(c, true); ok {
+			return input, true
+		}
+	}
+
+	return peer.RequestPieceInput{}, false
+}
+
+// isEndgame reports whether every missing piece is being downloaded and all
+// their blocks have been requested.
+func (s *session) isEndgame() bool {
+	if len(s.active)+len(s.verifying) < s.remaining {
+		return false
+	}
+
+	for _, p := range s.active {
+		if p.hasUnrequestedBlocks() {
+			return false
+		}
+	}
+
+	return true
+}
+
+// receive stores a block sent by c and starts verifying the piece once it is
+// complete. It returns the other peers the block was requested from in
+// endgame mode, whose requests should be cancelled.
+func (s *session) receive(c *peer.Client, index, begin int, data []byte) []*peer.Client {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p := s.active[index]
+	if p == nil {
+		return nil
+	}
+
+	others, ok := p.receive(c, begin, data)
+	if ok {
+		s.stats.addDownloaded(len(data))
+	}
+	if !ok || p.missing > 0 {
+		return others
+	}
+
+	delete(s.active, index)
+	s.verifying[index] = true
+	s.verifyWg.Add(1)
+	go s.verify(p)
+
+	return others
+}
+
+// verify checks the hash of a complete piece. Pieces failing the check are
+// downloaded again and the peers that sent them are penalized.
+func (s *session) verify(p *pieceProgress) {
+	defer s.verifyWg.Done()
+
+	hash := sha1.Sum(p.data)
+	ok := hash == s.t.PieceHashes[p.index]
+
+	if ok {
+		s.pieceMu.Lock()
+		err := s.onPiece(p.index, p.data)
+		s.pieceMu.Unlock()
+
+		if err != nil {
+			s.cancel(err)
+			return
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.verifying, p.index)
+
+	if !ok {
+		s.recordHashFailure(p)
+		s.notifyReleased()
+		return
+	}
+
+	s.recordHashSuccess(p)
+
+	s.wanted.Clear(p.index)
+	s.remaining--
+	s.completed++
+	s.left -= len(p.data)
+	s.stats.setLeft(s.left)
+	if s.remaining == 0 {
+		close(s.done)
+	}
+}
+
+// release forgets the blocks requested from c so that other peers can request
+// them.
+func (s *session) release(c *peer.Client, inFlight map[blockKey]peer.RequestPieceInput) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key := range inFlight {
+		if p := s.active[key.index]; p != nil {
+			p.release(c, key.begin)
+		}
+	}
+
+	s.notifyReleased()
+}
+
+// pruneInFlight forgets the requests for blocks already received from other
+// peers, which were cancelled and may never arrive.
+func (s *session) pruneInFlight(inFlight map[blockKey]peer.RequestPieceInput) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key := range inFlight {
+		if p := s.active[key.index]; p == nil || p.isReceived(key.begin) {
+			delete(inFlight, key)
+		}
+	}
+}
+
+func (s *session) notifyReleased() {
+	close(s.released)
+	s.released = make(chan struct{})
+}
+
+func (s *session) releasedChan() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.released
+}
@@ -0,0 +1,48 @@
+package torrent
+
+import "sync/atomic"
+
+// Stats counts the data transferred for a torrent, as reported to trackers.
+// A nil *Stats counts nothing.
+type Stats struct {
+	uploaded   atomic.Int64
+	downloaded atomic.Int64
+	left       atomic.Int64
+}
+
+// NewStats returns the stats of a torrent with left bytes still to download.
+func NewStats(left int) *Stats {
+	s := &Stats{}
+	s.left.Store(int64(left))
+	return s
+}
+
+func (s *Stats) Uploaded() int {
+	return int(s.uploaded.Load())
+}
+
+func (s *Stats) Downloaded() int {
+	return int(s.downloaded.Load())
+}
+
+func (s *Stats) Left() int {
+	return int(s.left.Load())
+}
+
+func (s *Stats) addUploaded(n int) {
+	if s != nil {
+		s.uploaded.Add(int64(n))
+	}
+}
+
+func (s *Stats) addDownloaded(n int) {
+	if s != nil {
+		s.downloaded.Add(int64(n))
+	}
+}
+
+func (s *Stats) setLeft(n int) {
+	if s != nil {
+		s.left.Store(int64(n))
+	}
+}
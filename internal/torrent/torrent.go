@@ -1,38 +1,100 @@
 package torrent
 
 import (
-	"bytes"
-	"context"
 	"crypto/sha1"
+	"errors"
 	"fmt"
-	"math"
 	"os"
-	"sync"
+	"strings"
 
 	"github.com/codecrafters-io/bittorrent-starter-go/internal/bencode"
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/bitfield"
 	"github.com/codecrafters-io/bittorrent-starter-go/internal/peer"
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/storage"
 )
 
 type Torrent struct {
-	TrackerURL  string
+	TrackerURL string
+	// Trackers holds the tiers of tracker URLs to announce to. It is the
+	// announce list when the torrent has one, and the tracker URL alone
+	// otherwise.
+	Trackers    [][]string
+	Name        string
 	Length      int
 	Hash        [20]byte
 	PieceLength int
 	PieceHashes [][20]byte
+	// Files lists the files of a multi-file torrent in the order they are laid
+	// out in the piece space. It is empty for single-file torrents.
+	Files []File
+	// Private torrents only get peers from their trackers (BEP 27).
+	Private bool
+	// Info is the bencoded info dictionary, which Hash is the hash of.
+	Info []byte
 }
 
-func (t Torrent) Download(clients peer.Clients) ([]byte, error) {
-	data := make([]byte, t.Length)
+type File struct {
+	Path   []string
+	Length int
+	Offset int
+}
+
+func (t Torrent) IsMultiFile() bool {
+	return len(t.Files) > 0
+}
+
+type DownloadOptions struct {
+	// ResumeFile records the verified pieces so that an interrupted download
+	// only fetches what is still missing. It is not used when empty.
+	ResumeFile string
+	// Completed holds the pieces already in store, as returned by
+	// LoadCompletedPieces. They are loaded from ResumeFile when it is nil.
+	Completed bitfield.Bitfield
+	// Picker decides the order in which pieces are downloaded. Pieces are
+	// downloaded rarest first when it is nil.
+	Picker PiecePicker
+	// Stats counts the data downloaded and left to download when not nil.
+	Stats *Stats
+	// Peers receives the addresses of peers discovered during the download,
+	// which are connected to and downloaded from as well.
+	Peers <-chan []string
+	// Seeder, when not nil, uploads the pieces as soon as they are stored.
+	Seeder *Seeder
+	// Port is advertised to the peers connected to during the download as
+	// the port we accept connections on, unless 0.
+	Port int
+}
 
-	for i := range len(t.PieceHashes) {
-		pieceData, err := t.DownloadPiece(clients, i)
-		if err != nil {
-			return nil, err
+// Download fetches every missing piece from clients and writes it to store as
+// soon as it has been verified, so only the pieces in flight are held in
+// memory.
+func (t Torrent) Download(clients peer.Clients, store storage.Storage, opts DownloadOptions) error {
+	completed := opts.Completed
+	if completed == nil {
+		var err error
+		if completed, err = t.LoadCompletedPieces(store, opts.ResumeFile); err != nil {
+			return err
 		}
-		copy(data[i*t.PieceLength:], pieceData)
 	}
 
-	return data, nil
+	wanted := bitfield.New(len(t.PieceHashes))
+	for i := range t.PieceHashes {
+		if !completed.Has(i) {
+			wanted.Set(i)
+		}
+	}
+
+	s := t.newSession(clients, wanted, opts, func(index int, data []byte) error {
+		if _, err := store.WriteAt(data, int64(index*t.PieceLength)); err != nil {
+			return fmt.Errorf("could not store piece %v: %w", index, err)
+		}
+
+		completed.Set(index)
+		opts.Seeder.addPiece(index)
+		return t.writeResumeFile(opts.ResumeFile, completed)
+	})
+
+	return s.run()
 }
 
 func (t Torrent) DownloadPiece(clients peer.Clients, pieceIndex int) ([]byte, error) {
@@ -40,48 +102,19 @@ func (t Torrent) DownloadPiece(clients peer.Clients, pieceIndex int) ([]byte, er
 		return nil, fmt.Errorf("unexpected piece index: %v", pieceIndex)
 	}
 
-	const blockMaxSize = 16 * 1024
-	ctx, ctxCancel := context.WithCancelCause(context.Background())
-	pieceLength := min(t.PieceLength, t.Length-t.PieceLength*pieceIndex)
-	totalBlocks := int(math.Ceil(float64(pieceLength) / float64(blockMaxSize)))
-	tasks := make(chan peer.RequestPieceInput, totalBlocks)
-	results := make(chan peer.ReadPieceOutput, totalBlocks)
-	pieceData := make([]byte, pieceLength)
-	var wg sync.WaitGroup
-
-	for _, c := range clients {
-		wg.Add(1)
-		go func(c *peer.Client) {
-			defer wg.Done()
-			if err := downloadWorker(ctx, c, tasks, results); err != nil {
-				ctxCancel(err)
-			}
-		}(c)
-	}
+	wanted := bitfield.New(len(t.PieceHashes))
+	wanted.Set(pieceIndex)
 
-	for i := range totalBlocks {
-		blockLength := min(blockMaxSize, pieceLength-i*blockMaxSize)
-		if err := writeDownloadTask(ctx, tasks, peer.RequestPieceInput{Index: pieceIndex, Begin: i * blockMaxSize, Length: blockLength}); err != nil {
-			break
-		}
-	}
-	close(tasks)
-	wg.Wait()
+	var pieceData []byte
+	s := t.newSession(clients, wanted, DownloadOptions{}, func(_ int, data []byte) error {
+		pieceData = data
+		return nil
+	})
 
-	if err := context.Cause(ctx); err != nil {
+	if err := s.run(); err != nil {
 		return nil, err
 	}
 
-	for range totalBlocks {
-		output := <-results
-		copy(pieceData[output.Begin:], output.Data)
-	}
-
-	hash := sha1.Sum(pieceData)
-	if !bytes.Equal(hash[:], t.PieceHashes[pieceIndex][:]) {
-		return nil, fmt.Errorf("could not check integrity of piece %v", pieceIndex)
-	}
-
 	return pieceData, nil
 }
 
@@ -99,14 +132,81 @@ func FromFile(file string) (Torrent, error) {
 	return torrent, nil
 }
 
+// Metainfo returns the bencoded metainfo of the torrent, the content of its
+// .torrent file. Info is written as is, so that the info hash of the file is
+// Hash.
+func (t Torrent) Metainfo() ([]byte, error) {
+	if t.Info == nil {
+		return nil, errors.New("torrent has no info dictionary")
+	}
+
+	metainfo := map[string]interface{}{"info": bencode.Raw(t.Info)}
+	if t.TrackerURL != "" {
+		metainfo["announce"] = t.TrackerURL
+	}
+	// A single tracker only needs the announce key.
+	if len(t.Trackers) > 1 || len(t.Trackers) == 1 && len(t.Trackers[0]) > 1 {
+		metainfo["announce-list"] = encodeTiers(t.Trackers)
+	}
+
+	return bencode.Encode(metainfo)
+}
+
 func parseTorrentData(data []byte) (Torrent, error) {
 	decodedValue, err := bencode.Decode(data)
 	if err != nil {
 		return Torrent{}, fmt.Errorf("could not decode torrent data: %w", err)
 	}
 
-	dict := decodedValue.(map[string]interface{})
-	info := dict["info"].(map[string]interface{})
+	dict, ok := decodedValue.(map[string]interface{})
+	if !ok {
+		return Torrent{}, errors.New("torrent data is not a dictionary")
+	}
+
+	info, ok := dict["info"].(map[string]interface{})
+	if !ok {
+		return Torrent{}, errors.New("torrent data has no info dictionary")
+	}
+
+	t, err := parseInfo(info)
+	if err != nil {
+		return Torrent{}, err
+	}
+
+	t.TrackerURL, _ = dict["announce"].(string)
+	t.Trackers = parseAnnounceList(dict["announce-list"])
+	if len(t.Trackers) == 0 && t.TrackerURL != "" {
+		t.Trackers = [][]string{{t.TrackerURL}}
+	}
+
+	return t, nil
+}
+
+// parseAnnounceList returns the tiers of an announce list, skipping the
+// entries that are not tracker URLs.
+func parseAnnounceList(rawList interface{}) [][]string {
+	list, _ := rawList.([]interface{})
+
+	var tiers [][]string
+	for _, rawTier := range list {
+		rawURLs, _ := rawTier.([]interface{})
+
+		var tier []string
+		for _, rawURL := range rawURLs {
+			if u, ok := rawURL.(string); ok && u != "" {
+				tier = append(tier, u)
+			}
+		}
+
+		if len(tier) > 0 {
+			tiers = append(tiers, tier)
+		}
+	}
+
+	return tiers
+}
+
+func parseInfo(info map[string]interface{}) (Torrent, error) {
 	h := sha1.New()
 
 	encodedInfo, err := bencode.Encode(info)
@@ -118,74 +218,97 @@ func parseTorrentData(data []byte) (Torrent, error) {
 		return Torrent{}, fmt.Errorf("could not create torrent hash: %w", err)
 	}
 
-	rawPieces := info["pieces"].(string)
+	name, _ := info["name"].(string)
+	pieceLength, ok := info["piece length"].(int)
+	if !ok || pieceLength <= 0 {
+		return Torrent{}, errors.New("invalid torrent piece length")
+	}
+
+	rawPieces, ok := info["pieces"].(string)
+	if !ok || len(rawPieces)%20 != 0 {
+		return Torrent{}, errors.New("invalid torrent piece hashes")
+	}
+
 	pieceHashes := make([][20]byte, len(rawPieces)/20)
 	for i := range pieceHashes {
 		copy(pieceHashes[i][:], rawPieces[i*20:])
 	}
 
-	return Torrent{
-		TrackerURL:  dict["announce"].(string),
-		Length:      info["length"].(int),
+	private, _ := info["private"].(int)
+
+	t := Torrent{
+		Name:        name,
 		Hash:        [20]byte(h.Sum(nil)),
-		PieceLength: info["piece length"].(int),
+		PieceLength: pieceLength,
 		PieceHashes: pieceHashes,
-	}, nil
-}
-
-func writeDownloadTask(ctx context.Context, tasks chan<- peer.RequestPieceInput, task peer.RequestPieceInput) error {
-	select {
-	case <-ctx.Done():
-		return ctx.Err()
-	case tasks <- task:
-		return nil
+		Private:     private == 1,
+		Info:        encodedInfo,
 	}
-}
 
-func readDownloadTask(ctx context.Context, tasks <-chan peer.RequestPieceInput) (peer.RequestPieceInput, bool, error) {
-	select {
-	case <-ctx.Done():
-		return peer.RequestPieceInput{}, false, ctx.Err()
+	if rawFiles, ok := info["files"]; ok {
+		if !isValidPathComponent(name) {
+			return Torrent{}, fmt.Errorf("invalid torrent name: %q", name)
+		}
+		if t.Files, err = parseFiles(rawFiles); err != nil {
+			return Torrent{}, err
+		}
+		for _, f := range t.Files {
+			t.Length += f.Length
+		}
+	} else if t.Length, ok = info["length"].(int); !ok || t.Length < 0 {
+		return Torrent{}, errors.New("invalid torrent length")
+	}
 
-	case input, ok := <-tasks:
-		return input, ok, nil
+	if numPieces := (t.Length + t.PieceLength - 1) / t.PieceLength; numPieces != len(t.PieceHashes) {
+		return Torrent{}, fmt.Errorf("torrent has %v piece hashes but its length requires %v", len(t.PieceHashes), numPieces)
 	}
+
+	return t, nil
 }
 
-func downloadWorker(ctx context.Context, c *peer.Client, tasks <-chan peer.RequestPieceInput, results chan<- peer.ReadPieceOutput) error {
-	requestsInFlight := 0
-	tasksClosed := false
+func parseFiles(rawFiles interface{}) ([]File, error) {
+	list, ok := rawFiles.([]interface{})
+	if !ok || len(list) == 0 {
+		return nil, errors.New("invalid torrent file list")
+	}
 
-	for requestsInFlight > 0 || !tasksClosed {
-		if !tasksClosed && requestsInFlight < 5 {
-			input, ok, err := readDownloadTask(ctx, tasks)
-			if err != nil {
-				return err
-			}
+	files := make([]File, 0, len(list))
+	offset := 0
 
-			if !ok {
-				tasksClosed = true
-				continue
-			}
+	for i, item := range list {
+		dict, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("invalid torrent file entry %v", i)
+		}
 
-			if err := c.RequestPiece(input); err != nil {
-				return err
-			}
+		length, ok := dict["length"].(int)
+		if !ok || length < 0 {
+			return nil, fmt.Errorf("invalid length for torrent file entry %v", i)
+		}
 
-			requestsInFlight++
-			continue
+		rawPath, ok := dict["path"].([]interface{})
+		if !ok || len(rawPath) == 0 {
+			return nil, fmt.Errorf("invalid path for torrent file entry %v", i)
 		}
 
-		if requestsInFlight > 0 {
-			output, err := c.ReadPiece()
-			if err != nil {
-				return err
+		path := make([]string, len(rawPath))
+		for j, rawComponent := range rawPath {
+			component, ok := rawComponent.(string)
+			if !ok || !isValidPathComponent(component) {
+				return nil, fmt.Errorf("invalid path component for torrent file entry %v: %q", i, rawComponent)
 			}
-
-			requestsInFlight--
-			results <- output
+			path[j] = component
 		}
+
+		files = append(files, File{Path: path, Length: length, Offset: offset})
+		offset += length
 	}
 
-	return nil
+	return files, nil
+}
+
+// isValidPathComponent rejects path components that would escape the
+// torrent's directory once joined into a filesystem path.
+func isValidPathComponent(component string) bool {
+	return component != "" && component != "." && component != ".." && !strings.ContainsAny(component, "/\\\x00")
 }
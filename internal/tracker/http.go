@@ -0,0 +1,171 @@
+package tracker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/bencode"
+)
+
+var errScrapeUnsupported = errors.New("torrent tracker does not support scrape")
+
+func announceHTTP(ctx context.Context, u *url.URL, req AnnounceRequest) (AnnounceResponse, error) {
+	query := u.Query()
+	query.Add("info_hash", string(req.Hash[:]))
+	query.Add("peer_id", string(req.PeerID[:]))
+	query.Add("port", strconv.Itoa(req.Port))
+	query.Add("uploaded", strconv.Itoa(req.Uploaded))
+	query.Add("downloaded", strconv.Itoa(req.Downloaded))
+	query.Add("left", strconv.Itoa(req.Left))
+	query.Add("compact", "1")
+	if req.Event != EventNone {
+		query.Add("event", req.Event.String())
+	}
+	if req.TrackerID != "" {
+		query.Add("trackerid", req.TrackerID)
+	}
+	u.RawQuery = query.Encode()
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return AnnounceResponse{}, fmt.Errorf("could not create torrent tracker request: %w", err)
+	}
+
+	r, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		return AnnounceResponse{}, fmt.Errorf("could not request torrent tracker URL: %w", err)
+	}
+	defer r.Body.Close()
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return AnnounceResponse{}, fmt.Errorf("could not read torrent tracker response: %w", err)
+	}
+
+	m, err := decodeHTTPResponse(r, body)
+	if err != nil {
+		return AnnounceResponse{}, err
+	}
+
+	return parseAnnounceResponse(m), nil
+}
+
+// decodeHTTPResponse decodes the dictionary a tracker responded with, and
+// turns a failure reason into an error.
+func decodeHTTPResponse(r *http.Response, body []byte) (map[string]interface{}, error) {
+	obj, err := bencode.Decode(body)
+	if err != nil {
+		if r.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("unexpected torrent tracker response status: %s", r.Status)
+		}
+		return nil, fmt.Errorf("could not decode torrent tracker response: %w", err)
+	}
+
+	m, ok := obj.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("torrent tracker response is not a dictionary")
+	}
+
+	if reason, ok := m["failure reason"].(string); ok {
+		return nil, &Error{Reason: reason}
+	}
+
+	return m, nil
+}
+
+func parseAnnounceResponse(m map[string]interface{}) AnnounceResponse {
+	var resp AnnounceResponse
+
+	interval, _ := m["interval"].(int)
+	minInterval, _ := m["min interval"].(int)
+	resp.Interval = time.Duration(interval) * time.Second
+	resp.MinInterval = time.Duration(minInterval) * time.Second
+
+	resp.Seeders, _ = m["complete"].(int)
+	resp.Leechers, _ = m["incomplete"].(int)
+	resp.Warning, _ = m["warning message"].(string)
+	resp.TrackerID, _ = m["tracker id"].(string)
+
+	switch peers := m["peers"].(type) {
+	case string:
+		resp.Peers = parseCompactPeers([]byte(peers), net.IPv4len)
+	case []interface{}:
+		resp.Peers = parsePeerList(peers)
+	}
+
+	if peers6, ok := m["peers6"].(string); ok {
+		resp.Peers = append(resp.Peers, parseCompactPeers([]byte(peers6), net.IPv6len)...)
+	}
+
+	return resp
+}
+
+func scrapeHTTP(ctx context.Context, u *url.URL, hash [20]byte) (ScrapeResponse, error) {
+	u, err := scrapeURL(u)
+	if err != nil {
+		return ScrapeResponse{}, err
+	}
+
+	query := u.Query()
+	query.Add("info_hash", string(hash[:]))
+	u.RawQuery = query.Encode()
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return ScrapeResponse{}, fmt.Errorf("could not create torrent tracker request: %w", err)
+	}
+
+	r, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		return ScrapeResponse{}, fmt.Errorf("could not request torrent tracker scrape URL: %w", err)
+	}
+	defer r.Body.Close()
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return ScrapeResponse{}, fmt.Errorf("could not read torrent tracker response: %w", err)
+	}
+
+	m, err := decodeHTTPResponse(r, body)
+	if err != nil {
+		return ScrapeResponse{}, err
+	}
+
+	files, _ := m["files"].(map[string]interface{})
+	stats, ok := files[string(hash[:])].(map[string]interface{})
+	if !ok {
+		return ScrapeResponse{}, errors.New("torrent tracker has no statistics for the torrent")
+	}
+
+	var resp ScrapeResponse
+	resp.Seeders, _ = stats["complete"].(int)
+	resp.Completed, _ = stats["downloaded"].(int)
+	resp.Leechers, _ = stats["incomplete"].(int)
+
+	return resp, nil
+}
+
+// scrapeURL derives the scrape URL of a tracker from its announce URL, by
+// replacing "announce" with "scrape" at the start of the last path component.
+// Trackers whose announce URL does not follow that convention do not support
+// scrape.
+func scrapeURL(announceURL *url.URL) (*url.URL, error) {
+	i := strings.LastIndex(announceURL.Path, "/")
+	if !strings.HasPrefix(announceURL.Path[i+1:], "announce") {
+		return nil, errScrapeUnsupported
+	}
+
+	u := *announceURL
+	u.Path = announceURL.Path[:i+1] + "scrape" + strings.TrimPrefix(announceURL.Path[i+1:], "announce")
+	u.RawPath = ""
+
+	return &u, nil
+}
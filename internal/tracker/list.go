@@ -0,0 +1,171 @@
+package tracker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"time"
+)
+
+// trackerTimeout bounds how long each tracker of a tier but the last is waited
+// for.
+const trackerTimeout = 20 * time.Second
+
+// List is a multi-tracker announce list (BEP 12). Trackers are grouped in
+// tiers, tried in order within a tier until one responds, and the one that
+// responded is moved to the front of its tier so that it is tried first next
+// time.
+type List struct {
+	mu    sync.Mutex
+	tiers [][]string
+	// trackerIDs holds the tracker IDs the trackers gave, by tracker URL.
+	trackerIDs map[string]string
+}
+
+// NewList returns an announce list of the given tiers, each of them shuffled.
+// Empty tiers and duplicate trackers are dropped.
+func NewList(tiers [][]string) *List {
+	seen := map[string]bool{}
+	l := &List{trackerIDs: map[string]string{}}
+
+	for _, tier := range tiers {
+		var urls []string
+		for _, u := range tier {
+			if u != "" && !seen[u] {
+				seen[u] = true
+				urls = append(urls, u)
+			}
+		}
+
+		if len(urls) > 0 {
+			rand.Shuffle(len(urls), func(i, j int) { urls[i], urls[j] = urls[j], urls[i] })
+			l.tiers = append(l.tiers, urls)
+		}
+	}
+
+	return l
+}
+
+// Tiers returns the trackers of the list, in the order they are tried.
+func (l *List) Tiers() [][]string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	tiers := make([][]string, len(l.tiers))
+	for i, tier := range l.tiers {
+		tiers[i] = slices.Clone(tier)
+	}
+
+	return tiers
+}
+
+// Announce announces to one tracker of every tier at once and merges their
+// responses, so that the peers known to any of them are returned. It only
+// fails when no tracker responded.
+func (l *List) Announce(ctx context.Context, req AnnounceRequest) (AnnounceResponse, error) {
+	tiers := l.Tiers()
+	if len(tiers) == 0 {
+		return AnnounceResponse{}, errors.New("torrent has no tracker")
+	}
+
+	type result struct {
+		resp AnnounceResponse
+		err  error
+	}
+
+	results := make(chan result, len(tiers))
+	for i := range tiers {
+		go func(i int) {
+			resp, err := l.announceTier(ctx, i, tiers[i], req)
+			results <- result{resp, err}
+		}(i)
+	}
+
+	var merged AnnounceResponse
+	var errs []error
+	seen := map[string]bool{}
+
+	for range tiers {
+		r := <-results
+		if r.err != nil {
+			errs = append(errs, r.err)
+			continue
+		}
+
+		for _, p := range r.resp.Peers {
+			if !seen[p.String()] {
+				seen[p.String()] = true
+				merged.Peers = append(merged.Peers, p)
+			}
+		}
+
+		if merged.Interval == 0 || (r.resp.Interval > 0 && r.resp.Interval < merged.Interval) {
+			merged.Interval = r.resp.Interval
+		}
+		merged.MinInterval = max(merged.MinInterval, r.resp.MinInterval)
+		merged.Seeders = max(merged.Seeders, r.resp.Seeders)
+		merged.Leechers = max(merged.Leechers, r.resp.Leechers)
+		if merged.Warning == "" {
+			merged.Warning = r.resp.Warning
+		}
+	}
+
+	if len(errs) == len(tiers) {
+		return AnnounceResponse{}, errors.Join(errs...)
+	}
+
+	return merged, nil
+}
+
+// announceTier announces to the trackers of the tier at index i in turn until
+// one responds, and promotes it to the front of the tier.
+func (l *List) announceTier(ctx context.Context, i int, tier []string, req AnnounceRequest) (AnnounceResponse, error) {
+	var errs []error
+
+	for j, trackerURL := range tier {
+		l.mu.Lock()
+		req.TrackerID = l.trackerIDs[trackerURL]
+		l.mu.Unlock()
+
+		// An unresponsive tracker must leave time to try the next ones, as
+		// UDP trackers alone are retried for minutes.
+		trackerCtx, cancel := ctx, func() {}
+		if j < len(tier)-1 {
+			trackerCtx, cancel = context.WithTimeout(ctx, trackerTimeout)
+		}
+		resp, err := Announce(trackerCtx, trackerURL, req)
+		cancel()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", trackerURL, err))
+			if ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+
+		l.mu.Lock()
+		if resp.TrackerID != "" {
+			l.trackerIDs[trackerURL] = resp.TrackerID
+		}
+		l.mu.Unlock()
+
+		l.promote(i, trackerURL)
+		return resp, nil
+	}
+
+	return AnnounceResponse{}, errors.Join(errs...)
+}
+
+func (l *List) promote(i int, trackerURL string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	tier := l.tiers[i]
+	if j := slices.Index(tier, trackerURL); j > 0 {
+		copy(tier[1:j+1], tier[:j])
+		tier[0] = trackerURL
+	}
+}
@@ -0,0 +1,53 @@
+package tracker
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+// parseCompactPeers parses a list of peers of 6 bytes each for IPv4 or 18
+// bytes each for IPv6 (BEP 7), the address followed by the port.
+func parseCompactPeers(b []byte, ipLength int) []net.TCPAddr {
+	var peers []net.TCPAddr
+
+	for i := 0; i+ipLength+2 <= len(b); i += ipLength + 2 {
+		peers = append(peers, net.TCPAddr{
+			IP:   net.IP(append([]byte(nil), b[i:i+ipLength]...)),
+			Port: int(binary.BigEndian.Uint16(b[i+ipLength:])),
+		})
+	}
+
+	return peers
+}
+
+// parsePeerList parses the original peer list, made of a dictionary per peer.
+// Peers given by host name rather than IP address are skipped.
+func parsePeerList(list []interface{}) []net.TCPAddr {
+	var peers []net.TCPAddr
+
+	for _, item := range list {
+		dict, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		rawIP, _ := dict["ip"].(string)
+		port, ok := dict["port"].(int)
+		ip := net.ParseIP(rawIP)
+		if ip == nil || !ok || port <= 0 || port > 65535 {
+			continue
+		}
+
+		peers = append(peers, net.TCPAddr{IP: ip, Port: port})
+	}
+
+	return peers
+}
+
+func addressStrings(addrs []net.TCPAddr) []string {
+	s := make([]string, len(addrs))
+	for i, addr := range addrs {
+		s[i] = addr.String()
+	}
+	return s
+}
@@ -0,0 +1,229 @@
+package tracker
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/peer"
+)
+
+const (
+	// defaultInterval is how long to wait between announces when the trackers
+	// do not say.
+	defaultInterval = 30 * time.Minute
+	// minRetryInterval and maxRetryInterval bound the delay before announcing
+	// again after every tracker failed, which doubles on each failure.
+	minRetryInterval = time.Minute
+	maxRetryInterval = 30 * time.Minute
+	// stopTimeout bounds how long Stop waits for the trackers, so that a
+	// tracker going away does not hold up the shutdown.
+	stopTimeout = 5 * time.Second
+)
+
+// Counters reports the amounts of data announced to the trackers.
+type Counters interface {
+	Uploaded() int
+	Downloaded() int
+	Left() int
+}
+
+// Session announces a torrent to its trackers for as long as it is
+// downloaded or seeded: the started event first, then periodically at the
+// interval the trackers ask for, the completed event once the download
+// completes and the stopped event on shutdown.
+type Session struct {
+	list     *List
+	hash     [20]byte
+	port     int
+	counters Counters
+
+	peers     chan []string
+	warnings  chan string
+	completed chan struct{}
+	// ctx is cancelled by Stop to interrupt the announce in progress.
+	ctx      context.Context
+	cancel   context.CancelFunc
+	stop     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+func NewSession(tiers [][]string, hash [20]byte, port int, counters Counters) *Session {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &Session{
+		list:      NewList(tiers),
+		hash:      hash,
+		port:      port,
+		counters:  counters,
+		peers:     make(chan []string, 1),
+		warnings:  make(chan string, 1),
+		completed: make(chan struct{}, 1),
+		ctx:       ctx,
+		cancel:    cancel,
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+}
+
+// Start sends the started event and returns the peers the trackers know
+// about. The torrent is then announced in the background until Stop is
+// called, even when the started event failed.
+func (s *Session) Start() ([]string, error) {
+	ctx, cancel := context.WithTimeout(s.ctx, fetchTimeout)
+	defer cancel()
+
+	resp, err := s.list.Announce(ctx, s.request(EventStarted))
+	s.warn(resp.Warning)
+
+	next := s.nextAnnounce(resp, err, minRetryInterval)
+	go s.loop(next)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return addressStrings(resp.Peers), nil
+}
+
+// Peers returns a channel receiving the peers found by the announces
+// following the started event.
+func (s *Session) Peers() <-chan []string {
+	return s.peers
+}
+
+// Warnings returns a channel receiving the warnings the trackers send, which is
+// closed once the session stops.
+func (s *Session) Warnings() <-chan string {
+	return s.warnings
+}
+
+// Completed sends the completed event to the trackers.
+func (s *Session) Completed() {
+	select {
+	case s.completed <- struct{}{}:
+	default:
+	}
+}
+
+// Stop sends the stopped event to the trackers and ends the session.
+func (s *Session) Stop() {
+	s.stopOnce.Do(func() {
+		close(s.stop)
+		s.cancel()
+		<-s.done
+	})
+}
+
+func (s *Session) loop(next time.Duration) {
+	defer close(s.done)
+	defer close(s.warnings)
+
+	retry := minRetryInterval
+	timer := time.NewTimer(next)
+	defer timer.Stop()
+
+	for {
+		event := EventNone
+
+		select {
+		case <-s.stop:
+			// A completion right before stopping is still worth reporting.
+			select {
+			case <-s.completed:
+				s.announceStopping(EventCompleted)
+			default:
+			}
+			s.announceStopping(EventStopped)
+			return
+
+		case <-s.completed:
+			event = EventCompleted
+
+		case <-timer.C:
+		}
+
+		// Stopping does not interrupt the completed event, so that it is not
+		// lost when the process exits right after completing the download.
+		parent := s.ctx
+		if event == EventCompleted {
+			parent = context.WithoutCancel(s.ctx)
+		}
+
+		ctx, cancel := context.WithTimeout(parent, fetchTimeout)
+		resp, err := s.list.Announce(ctx, s.request(event))
+		cancel()
+
+		if err != nil {
+			retry = min(retry*2, maxRetryInterval)
+		} else {
+			retry = minRetryInterval
+			s.publish(addressStrings(resp.Peers))
+			s.warn(resp.Warning)
+		}
+
+		timer.Stop()
+		timer.Reset(s.nextAnnounce(resp, err, retry))
+	}
+}
+
+func (s *Session) announceStopping(event Event) {
+	ctx, cancel := context.WithTimeout(context.Background(), stopTimeout)
+	defer cancel()
+	s.list.Announce(ctx, s.request(event))
+}
+
+// publish hands peers over to the consumer of Peers. When it has not taken
+// the previous ones yet, they are merged.
+func (s *Session) publish(peers []string) {
+	if len(peers) == 0 {
+		return
+	}
+
+	select {
+	case previous := <-s.peers:
+		peers = append(previous, peers...)
+	default:
+	}
+
+	s.peers <- peers
+}
+
+// warn hands a warning over to the consumer of Warnings, unless it is empty or
+// the previous one was not taken yet.
+func (s *Session) warn(warning string) {
+	if warning == "" {
+		return
+	}
+
+	select {
+	case s.warnings <- warning:
+	default:
+	}
+}
+
+func (s *Session) nextAnnounce(resp AnnounceResponse, err error, retry time.Duration) time.Duration {
+	if err != nil {
+		return retry
+	}
+
+	interval := resp.Interval
+	if interval <= 0 {
+		interval = defaultInterval
+	}
+
+	return max(interval, resp.MinInterval)
+}
+
+func (s *Session) request(event Event) AnnounceRequest {
+	return AnnounceRequest{
+		Hash:       s.hash,
+		PeerID:     peer.LocalID(),
+		Port:       s.port,
+		Uploaded:   s.counters.Uploaded(),
+		Downloaded: s.counters.Downloaded(),
+		Left:       s.counters.Left(),
+		Event:      event,
+	}
+}
@@ -0,0 +1,140 @@
+package tracker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/peer"
+)
+
+// Event tells the tracker about a change in the state of the download. The
+// values are those of the UDP tracker protocol.
+type Event int
+
+const (
+	EventNone Event = iota
+	EventCompleted
+	EventStarted
+	EventStopped
+)
+
+func (e Event) String() string {
+	switch e {
+	case EventCompleted:
+		return "completed"
+	case EventStarted:
+		return "started"
+	case EventStopped:
+		return "stopped"
+	default:
+		return ""
+	}
+}
+
+type AnnounceRequest struct {
+	Hash       [20]byte
+	PeerID     [20]byte
+	Port       int
+	Uploaded   int
+	Downloaded int
+	Left       int
+	Event      Event
+	// TrackerID is the ID the tracker gave in a previous response, if any.
+	TrackerID string
+}
+
+type AnnounceResponse struct {
+	// Interval is how long the tracker asks to wait before announcing again.
+	// It is zero when the tracker did not say.
+	Interval time.Duration
+	// MinInterval is how long the tracker requires to wait before announcing
+	// again. It is zero when the tracker did not say.
+	MinInterval time.Duration
+	Peers       []net.TCPAddr
+	Seeders     int
+	Leechers    int
+	// Warning is a message the tracker sent along with a successful response.
+	Warning string
+	// TrackerID is to be sent back to the tracker on the next announces.
+	TrackerID string
+}
+
+type ScrapeResponse struct {
+	Seeders   int
+	Completed int
+	Leechers  int
+}
+
+// fetchTimeout bounds how long FetchAddresses waits for the trackers.
+const fetchTimeout = time.Minute
+
+var errUnsupportedScheme = errors.New("unsupported torrent tracker URL scheme")
+
+// Error is a failure reported by a tracker, as opposed to a failure to reach
+// it.
+type Error struct {
+	Reason string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("torrent tracker failure: %s", e.Reason)
+}
+
+// Announce tells the tracker about us and returns the peers it knows about.
+// The protocol is chosen by the scheme of the tracker URL.
+func Announce(ctx context.Context, trackerURL string, req AnnounceRequest) (AnnounceResponse, error) {
+	u, err := url.Parse(trackerURL)
+	if err != nil {
+		return AnnounceResponse{}, fmt.Errorf("could not parse torrent tracker URL: %w", err)
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+		return announceHTTP(ctx, u, req)
+	case "udp":
+		return announceUDP(ctx, u, req)
+	default:
+		return AnnounceResponse{}, fmt.Errorf("%w: %q", errUnsupportedScheme, u.Scheme)
+	}
+}
+
+// Scrape returns the swarm statistics the tracker has for a torrent.
+func Scrape(ctx context.Context, trackerURL string, hash [20]byte) (ScrapeResponse, error) {
+	u, err := url.Parse(trackerURL)
+	if err != nil {
+		return ScrapeResponse{}, fmt.Errorf("could not parse torrent tracker URL: %w", err)
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+		return scrapeHTTP(ctx, u, hash)
+	case "udp":
+		return scrapeUDP(ctx, u, hash)
+	default:
+		return ScrapeResponse{}, fmt.Errorf("%w: %q", errUnsupportedScheme, u.Scheme)
+	}
+}
+
+// FetchAddresses announces us to the trackers of an announce list and returns
+// the addresses of the peers they know about, along with the warning one of
+// them may have sent.
+func FetchAddresses(tiers [][]string, hash [20]byte, left, port int) ([]string, string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), fetchTimeout)
+	defer cancel()
+
+	resp, err := NewList(tiers).Announce(ctx, AnnounceRequest{
+		Hash:   hash,
+		PeerID: peer.LocalID(),
+		Port:   port,
+		Left:   left,
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	return addressStrings(resp.Peers), resp.Warning, nil
+}
@@ -0,0 +1,256 @@
+package tracker
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	udpProtocolID = 0x41727101980
+
+	udpConnectAction  uint32 = 0
+	udpAnnounceAction uint32 = 1
+	udpScrapeAction   uint32 = 2
+	udpErrorAction    uint32 = 3
+
+	// Requests are retransmitted after 15 * 2^n seconds, n going from 0 to
+	// udpMaxRetransmissions, as BEP 15 recommends.
+	udpBaseTimeout        = 15 * time.Second
+	udpMaxRetransmissions = 8
+
+	// udpConnectionIDLifetime is how long a connection ID may be used once
+	// obtained from a tracker.
+	udpConnectionIDLifetime = time.Minute
+
+	udpMaxPacketSize = 64 * 1024
+)
+
+var errUDPTimeout = errors.New("torrent tracker did not respond")
+
+type udpConnectionID struct {
+	id        uint64
+	expiresAt time.Time
+}
+
+// udpConnectionIDs caches the connection IDs by tracker address, so that
+// successive requests to a tracker skip the connect transaction.
+var udpConnectionIDs = struct {
+	sync.Mutex
+	ids map[string]udpConnectionID
+}{ids: map[string]udpConnectionID{}}
+
+// udpKey identifies us to trackers across IP address changes.
+var udpKey = rand.Uint32()
+
+type udpTracker struct {
+	conn net.Conn
+}
+
+// dialUDPTracker connects to a tracker. The connection is closed as soon as
+// ctx is done, which interrupts any pending request.
+func dialUDPTracker(ctx context.Context, u *url.URL) (*udpTracker, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", u.Host)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to torrent tracker: %w", err)
+	}
+
+	context.AfterFunc(ctx, func() { conn.Close() })
+
+	return &udpTracker{conn: conn}, nil
+}
+
+func announceUDP(ctx context.Context, u *url.URL, req AnnounceRequest) (AnnounceResponse, error) {
+	t, err := dialUDPTracker(ctx, u)
+	if err != nil {
+		return AnnounceResponse{}, err
+	}
+	defer t.conn.Close()
+
+	body := make([]byte, 0, 82)
+	body = append(body, req.Hash[:]...)
+	body = append(body, req.PeerID[:]...)
+	body = binary.BigEndian.AppendUint64(body, uint64(req.Downloaded))
+	body = binary.BigEndian.AppendUint64(body, uint64(req.Left))
+	body = binary.BigEndian.AppendUint64(body, uint64(req.Uploaded))
+	body = binary.BigEndian.AppendUint32(body, uint32(req.Event))
+	body = binary.BigEndian.AppendUint32(body, 0) // IP address, the sender's
+	body = binary.BigEndian.AppendUint32(body, udpKey)
+	body = binary.BigEndian.AppendUint32(body, ^uint32(0)) // num_want, the default
+	body = binary.BigEndian.AppendUint16(body, uint16(req.Port))
+
+	resp, err := t.request(ctx, udpAnnounceAction, body)
+	if err != nil {
+		return AnnounceResponse{}, err
+	}
+
+	if len(resp) < 12 {
+		return AnnounceResponse{}, fmt.Errorf("invalid torrent tracker announce response length: %v", len(resp))
+	}
+
+	return AnnounceResponse{
+		Interval: time.Duration(binary.BigEndian.Uint32(resp)) * time.Second,
+		Leechers: int(binary.BigEndian.Uint32(resp[4:])),
+		Seeders:  int(binary.BigEndian.Uint32(resp[8:])),
+		Peers:    parseCompactPeers(resp[12:], t.ipLength()),
+	}, nil
+}
+
+func scrapeUDP(ctx context.Context, u *url.URL, hash [20]byte) (ScrapeResponse, error) {
+	t, err := dialUDPTracker(ctx, u)
+	if err != nil {
+		return ScrapeResponse{}, err
+	}
+	defer t.conn.Close()
+
+	resp, err := t.request(ctx, udpScrapeAction, hash[:])
+	if err != nil {
+		return ScrapeResponse{}, err
+	}
+
+	if len(resp) < 12 {
+		return ScrapeResponse{}, fmt.Errorf("invalid torrent tracker scrape response length: %v", len(resp))
+	}
+
+	return ScrapeResponse{
+		Seeders:   int(binary.BigEndian.Uint32(resp)),
+		Completed: int(binary.BigEndian.Uint32(resp[4:])),
+		Leechers:  int(binary.BigEndian.Uint32(resp[8:])),
+	}, nil
+}
+
+// request sends a request for action with the given body and returns the body
+// of the response. The connection ID is renewed whenever it expires, including
+// between retransmissions.
+func (t *udpTracker) request(ctx context.Context, action uint32, body []byte) ([]byte, error) {
+	for n := 0; n <= udpMaxRetransmissions; n++ {
+		connectionID, err := t.connectionID(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		transactionID := rand.Uint32()
+		packet := binary.BigEndian.AppendUint64(nil, connectionID)
+		packet = binary.BigEndian.AppendUint32(packet, action)
+		packet = binary.BigEndian.AppendUint32(packet, transactionID)
+		packet = append(packet, body...)
+
+		resp, err := t.exchange(ctx, packet, action, transactionID, udpTimeout(n))
+		if errors.Is(err, errUDPTimeout) {
+			continue
+		}
+
+		return resp, err
+	}
+
+	return nil, errUDPTimeout
+}
+
+// connectionID returns the cached connection ID for the tracker, or obtains a
+// new one.
+func (t *udpTracker) connectionID(ctx context.Context) (uint64, error) {
+	addr := t.conn.RemoteAddr().String()
+
+	udpConnectionIDs.Lock()
+	cached, ok := udpConnectionIDs.ids[addr]
+	udpConnectionIDs.Unlock()
+
+	if ok && time.Now().Before(cached.expiresAt) {
+		return cached.id, nil
+	}
+
+	for n := 0; n <= udpMaxRetransmissions; n++ {
+		transactionID := rand.Uint32()
+		packet := binary.BigEndian.AppendUint64(nil, udpProtocolID)
+		packet = binary.BigEndian.AppendUint32(packet, udpConnectAction)
+		packet = binary.BigEndian.AppendUint32(packet, transactionID)
+
+		obtainedAt := time.Now()
+		resp, err := t.exchange(ctx, packet, udpConnectAction, transactionID, udpTimeout(n))
+		if errors.Is(err, errUDPTimeout) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		if len(resp) < 8 {
+			return 0, fmt.Errorf("invalid torrent tracker connect response length: %v", len(resp))
+		}
+
+		id := binary.BigEndian.Uint64(resp)
+
+		udpConnectionIDs.Lock()
+		udpConnectionIDs.ids[addr] = udpConnectionID{id: id, expiresAt: obtainedAt.Add(udpConnectionIDLifetime)}
+		udpConnectionIDs.Unlock()
+
+		return id, nil
+	}
+
+	return 0, errUDPTimeout
+}
+
+// exchange sends a packet and waits for the response to its transaction. It
+// returns the response body, following the action and transaction ID, or
+// errUDPTimeout when no response arrives in time.
+func (t *udpTracker) exchange(ctx context.Context, packet []byte, action, transactionID uint32, timeout time.Duration) ([]byte, error) {
+	if _, err := t.conn.Write(packet); err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("could not send torrent tracker request: %w", err)
+	}
+
+	if err := t.conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, udpMaxPacketSize)
+	for {
+		n, err := t.conn.Read(buf)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return nil, errUDPTimeout
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, fmt.Errorf("could not read torrent tracker response: %w", err)
+		}
+
+		// Responses to earlier transmissions of a request are ignored.
+		if n < 8 || binary.BigEndian.Uint32(buf[4:]) != transactionID {
+			continue
+		}
+
+		switch respAction := binary.BigEndian.Uint32(buf); respAction {
+		case action:
+			return buf[8:n], nil
+		case udpErrorAction:
+			return nil, &Error{Reason: string(buf[8:n])}
+		default:
+			return nil, fmt.Errorf("unexpected torrent tracker response action: %v", respAction)
+		}
+	}
+}
+
+// ipLength returns the length of the peer addresses in announce responses,
+// which are IPv6 addresses when the tracker is reached over IPv6.
+func (t *udpTracker) ipLength() int {
+	if addr, ok := t.conn.RemoteAddr().(*net.UDPAddr); ok && addr.IP.To4() == nil {
+		return net.IPv6len
+	}
+	return net.IPv4len
+}
+
+func udpTimeout(n int) time.Duration {
+	return udpBaseTimeout << n
+}